@@ -0,0 +1,180 @@
+package melody
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ackPrefix = []byte("ack:")
+
+// defaultAckFormat prefixes msg with its sequence id, ie: "42:msg".
+func defaultAckFormat(id uint64, msg []byte) []byte {
+	buf := make([]byte, 0, len(msg)+21)
+	buf = strconv.AppendUint(buf, id, 10)
+	buf = append(buf, ':')
+	return append(buf, msg...)
+}
+
+// defaultAckParse recognizes acknowledgements of the form "ack:42".
+func defaultAckParse(msg []byte) (uint64, bool) {
+	if !bytes.HasPrefix(msg, ackPrefix) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(string(msg[len(ackPrefix):]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+type ackTracker struct {
+	mutex   sync.Mutex
+	next    uint64
+	pending map[uint64]*pendingAck
+	stopped bool // Set on teardown, no more timeouts are armed.
+}
+
+// pendingAck is a reliable message waiting on its acknowledgement.
+type pendingAck struct {
+	timer Timer
+	onAck func() // Fires when the message is acknowledged, if set.
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		pending: make(map[uint64]*pendingAck),
+	}
+}
+
+func (a *ackTracker) add(clock Clock, timeout time.Duration, fn func(uint64), onAck func()) uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.next++
+	id := a.next
+
+	p := &pendingAck{onAck: onAck}
+	if timeout > 0 && !a.stopped {
+		p.timer = clock.AfterFunc(timeout, func() {
+			if _, ok := a.remove(id); ok {
+				fn(id)
+			}
+		})
+	}
+	a.pending[id] = p
+
+	return id
+}
+
+// remove stops waiting on id and returns its onAck callback, it reports false
+// if id wasn't pending.
+func (a *ackTracker) remove(id uint64) (func(), bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	p, ok := a.pending[id]
+	if !ok {
+		return nil, false
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(a.pending, id)
+
+	return p.onAck, true
+}
+
+// stop forgets every pending message without firing its timeout, the
+// session is gone so none of them can be acknowledged any more.
+func (a *ackTracker) stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, p := range a.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+	a.pending = make(map[uint64]*pendingAck)
+	a.stopped = true
+}
+
+func (a *ackTracker) active() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.next > 0
+}
+
+func (a *ackTracker) len() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return len(a.pending)
+}
+
+// BroadcastAck tracks the acknowledgements of a message sent with
+// Melody.BroadcastReliable.
+type BroadcastAck struct {
+	mutex   sync.Mutex
+	pending map[*Session]bool
+	acked   chan *Session
+	done    chan struct{}
+}
+
+func newBroadcastAck(n int) *BroadcastAck {
+	return &BroadcastAck{
+		pending: make(map[*Session]bool, n),
+		acked:   make(chan *Session, n),
+		done:    make(chan struct{}),
+	}
+}
+
+func (b *BroadcastAck) ack(s *Session) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.pending[s] {
+		return
+	}
+
+	delete(b.pending, s)
+	b.acked <- s
+
+	if len(b.pending) == 0 {
+		close(b.done)
+	}
+}
+
+// Acked returns a channel that receives every session as it acknowledges
+// the message.
+func (b *BroadcastAck) Acked() <-chan *Session {
+	return b.acked
+}
+
+// Pending returns the number of sessions that have yet to acknowledge the
+// message.
+func (b *BroadcastAck) Pending() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.pending)
+}
+
+// Wait blocks until every session the message was sent to has acknowledged
+// it, or until ctx is done. Sessions that time out or disconnect never
+// acknowledge, so bound Wait with ctx.
+func (b *BroadcastAck) Wait(ctx context.Context) error {
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
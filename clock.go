@@ -0,0 +1,110 @@
+package melody
+
+import "time"
+
+// Clock is the source of time for the timers that drive sessions: the ping
+// ticker, connection lifetimes, the message rate window and connection age.
+// Connection read and write deadlines always use the system clock, as they
+// are enforced by the network connection itself.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker delivers ticks on C, see time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer fires once, see time.Timer.
+type Timer interface {
+	Stop() bool
+}
+
+// systemClock is the Clock backed by package time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// newTimer arms a timer on clock that signals the returned channel once d
+// has passed, like the channel of a time.Timer.
+func newTimer(clock Clock, d time.Duration) (<-chan struct{}, Timer) {
+	c := make(chan struct{}, 1)
+	timer := clock.AfterFunc(d, func() {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	})
+
+	return c, timer
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// idleTicker ticks once after a period without a reset, see
+// Config.PingOnlyWhenIdle. It needs rearming after every tick.
+type idleTicker struct {
+	clock Clock
+	timer Timer
+	c     chan time.Time
+}
+
+func newIdleTicker(clock Clock, d time.Duration) *idleTicker {
+	t := &idleTicker{clock: clock, c: make(chan time.Time, 1)}
+	t.timer = clock.AfterFunc(d, t.tick)
+
+	return t
+}
+
+func (t *idleTicker) tick() {
+	select {
+	case t.c <- t.clock.Now():
+	default:
+	}
+}
+
+func (t *idleTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *idleTicker) Stop() {
+	t.timer.Stop()
+}
+
+// rearm makes t tick d from now, dropping a tick that wasn't received yet.
+// The timer is reused when the Clock's timers can be reset, as the system
+// clock's can.
+func (t *idleTicker) rearm(d time.Duration) {
+	if timer, ok := t.timer.(interface {
+		Reset(time.Duration) bool
+	}); ok {
+		timer.Reset(d)
+	} else {
+		t.timer.Stop()
+		t.timer = t.clock.AfterFunc(d, t.tick)
+	}
+
+	select {
+	case <-t.c:
+	default:
+	}
+}
@@ -0,0 +1,78 @@
+package melody
+
+import "errors"
+
+var (
+	ErrNoBinaryCodec = errors.New("config binary codec is not set")
+)
+
+// BinaryCodec encodes and decodes typed binary messages, ie: protobuf or
+// flatbuffers. Encode must include the type of v in the message, so Type can
+// recover it from the other side.
+type BinaryCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Type(msg []byte) (name string, err error)
+	Decode(msg []byte, v interface{}) error
+}
+
+type binaryEvent struct {
+	newMessage func() interface{}
+	fn         func(*Session, interface{})
+}
+
+// OnBinary fires fn when a binary message whose type Config.BinaryCodec
+// reports as name comes in, instead of the HandleMessageBinary handler. The
+// message is decoded into a value made by newMessage. Decoding errors are
+// passed to the HandleError handler.
+func (m *Melody) OnBinary(name string, newMessage func() interface{}, fn func(*Session, interface{})) {
+	if m.binaryEvents == nil {
+		m.binaryEvents = make(map[string]binaryEvent)
+	}
+
+	m.binaryEvents[name] = binaryEvent{newMessage: newMessage, fn: fn}
+}
+
+// WriteEncoded writes v encoded by Config.BinaryCodec to session as a binary
+// message.
+func (s *Session) WriteEncoded(v interface{}) error {
+	codec := s.melody.config().BinaryCodec
+	if codec == nil {
+		return ErrNoBinaryCodec
+	}
+
+	msg, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return s.WriteBinary(msg)
+}
+
+// routeBinary fires the OnBinary handler registered for message and reports
+// whether there was one.
+func (s *Session) routeBinary(message []byte) bool {
+	codec := s.melody.config().BinaryCodec
+	if codec == nil || len(s.melody.binaryEvents) == 0 {
+		return false
+	}
+
+	name, err := codec.Type(message)
+	if err != nil {
+		return false
+	}
+
+	e, ok := s.melody.binaryEvents[name]
+	if !ok {
+		return false
+	}
+
+	v := e.newMessage()
+	if err := codec.Decode(message, v); err != nil {
+		s.melody.errorHandler(s, err)
+		return true
+	}
+
+	e.fn(s, v)
+
+	return true
+}
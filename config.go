@@ -1,22 +1,184 @@
 package melody
 
-import "time"
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrInvalidPingPeriod     = errors.New("config ping period must be positive")
+	ErrInvalidMaxMessageSize = errors.New("config max message size must not be negative")
+)
 
 // Config melody configuration struct.
 type Config struct {
-	WriteWait         time.Duration // Milliseconds until write times out.
-	PongWait          time.Duration // Timeout for waiting on pong.
-	PingPeriod        time.Duration // Milliseconds between pings.
-	MaxMessageSize    int64         // Maximum size in bytes of a message.
-	MessageBufferSize int           // The max amount of messages that can be in a sessions buffer before it starts dropping them.
+	WriteWait              time.Duration                         // Milliseconds until write times out.
+	CloseWait              time.Duration                         // Milliseconds until writing a close frame times out, zero uses WriteWait.
+	PongWait               time.Duration                         // Timeout for waiting on pong.
+	PingPeriod             time.Duration                         // Milliseconds between pings, must be positive and should be less than PongWait.
+	PingOnlyWhenIdle       bool                                  // Only ping a session after PingPeriod without a message from it, a message counts like a pong. Writes don't count, they keep succeeding on a dead connection until its send buffer fills.
+	MaxMessageSize         int64                                 // Maximum size in bytes of a message read from a session, zero disables the limit. Must not be negative.
+	MaxOutboundMessageSize int64                                 // Maximum size in bytes of a message written to a session, larger ones are rejected with ErrOutboundMessageTooBig. Zero disables the limit.
+	MessageBufferSize      int                                   // The max amount of messages that can be in a sessions buffer before it starts dropping them.
+	MaxQueuedBytes         int64                                 // The max amount of bytes that can be in a sessions buffer before it starts dropping messages, zero disables the limit.
+	MaxTotalBufferedBytes  int64                                 // The max amount of bytes that can be buffered across all sessions before they start dropping messages with ErrTotalBufferFull, zero disables the limit.
+	BroadcastSendTimeout   time.Duration                         // How long a broadcast waits on a session with a full buffer before skipping it, zero skips it at once.
+	BroadcastConcurrency   int                                   // Split a broadcast to every session between this many goroutines, one or less fans out serially.
+	ReadErrorBackoff       time.Duration                         // Delay before tearing down a session whose connection failed on read, smooths reconnection storms.
+	DrainOnClose           bool                                  // Flush buffered messages before answering a close frame from the session, bounded by WriteWait. Ignored with a custom HandleClose.
+	InboundWorkers         int                                   // Dispatch messages on a pool of this many goroutines instead of the reading goroutine, zero disables the pool. UpdateConfig can grow the pool but not shrink it.
+	InboundQueueSize       int                                   // The max amount of messages a session can have waiting on the pool before it starts dropping them.
+	ReadBufferMessages     int                                   // Buffer up to this many messages between reading a session and its handler, which runs on a goroutine of its own. Zero disables the buffer, ignored with InboundWorkers.
+	ReadBufferPolicy       ReadBufferPolicy                      // What to do when a session fills its ReadBufferMessages buffer, blocks reading by default.
+	HandlerTimeout         time.Duration                         // How long handling a message may take before the session is considered stuck, zero disables the watchdog.
+	HandlerTimeoutPolicy   HandlerTimeoutPolicy                  // What to do when a handler exceeds HandlerTimeout, only reports ErrHandlerTimeout by default.
+	AckTimeout             time.Duration                         // Timeout for waiting on the acknowledgement of a reliable message, zero waits forever.
+	AckFormat              func(id uint64, msg []byte) []byte    // Tags a reliable message with its sequence id, nil uses the "42:msg" default.
+	AckParse               func(msg []byte) (id uint64, ok bool) // Recognizes an acknowledgement sent by a session, nil uses the "ack:42" default.
+	MaxMessagesPerSecond   int                                   // Disconnect a session that sends more than this many messages within a second, zero disables the limit.
+	MaxConnections         int                                   // The max amount of connected sessions, further upgrades are refused with 503 Service Unavailable. Zero disables the limit.
+	FairAdmission          bool                                  // Once half of MaxConnections is in use, refuse upgrades from IPs that already hold their fair share, MaxConnections split evenly between connected IPs.
+	MaxConnectionLifetime  time.Duration                         // Close sessions once they have been connected this long so clients reconnect, zero disables the limit.
+	LifetimeCloseCode      int                                   // Close code sent to sessions that exceed MaxConnectionLifetime, zero sends CloseGoingAway.
+	ReplacedCloseCode      int                                   // Close code sent to sessions closed by Melody.ReplaceSession, zero sends ClosePolicyViolation.
+	PresenceKey            string                                // Session key holding the string identity tracked by HandleOnline and HandleOffline, empty disables presence.
+	PresenceDebounce       time.Duration                         // How long an identity without sessions waits for one to reconnect before it goes offline.
+	SlowClientThreshold    int                                   // Messages a session can have buffered before it counts as slow, it recovers once half as many are left. Zero disables slow client events.
+	Echo                   bool                                  // Write every text and binary message back to the session that sent it instead of handling it, ie: as a test endpoint for client development.
+	EchoAfterHandlers      bool                                  // With Echo, still handle messages and echo them afterwards.
+	EchoMaxSize            int64                                 // With Echo, don't echo messages larger than this many bytes, zero echoes any size.
+	CloseSpread            time.Duration                         // Spread the sessions closed by CloseAllWithMsg evenly over this window so clients don't all reconnect at once, zero closes them together.
+	PingSummaryInterval    time.Duration                         // How often HandlePingSummary fires with the pings and pongs counted since the last time.
+	EchoPingPayload        bool                                  // Answer pings from a session with a pong carrying the same payload, as RFC 6455 requires. Unset it to answer with empty pongs.
+
+	// UpgradeErrorHandler, if set, writes the HTTP response when upgrading a
+	// request to a websocket connection fails. It takes precedence over
+	// Upgrader.Error.
+	UpgradeErrorHandler func(w http.ResponseWriter, r *http.Request, status int, reason error)
+
+	// ErrorReplyFormatter builds the value written back as JSON when an event
+	// handler registered with On returns an error, nil uses the default.
+	ErrorReplyFormatter func(err error) interface{}
+
+	// ErrorFormat builds the message written by Session.WriteError, nil uses
+	// the default.
+	ErrorFormat func(code int, message string) []byte
+
+	// UnknownMessageHandler, if set, fires for messages read from a session
+	// that are neither text nor binary messages, which are otherwise dropped.
+	UnknownMessageHandler func(s *Session, t int, msg []byte)
+
+	// Clock is the source of time for session timers, it defaults to the
+	// system clock, also when nil. Replacing it lets tests drive pings,
+	// lifetimes and the other timeouts, set it with Melody.Configure so
+	// Melody.Uptime is measured on it too.
+	Clock Clock
+
+	// BinaryCodec encodes messages written with Session.WriteEncoded and
+	// decodes those routed to OnBinary handlers.
+	BinaryCodec BinaryCodec
+
+	// SlowClientEnterHandler, if set, fires when a session's buffer grows
+	// past SlowClientThreshold. SlowClientLeaveHandler fires once it has
+	// drained back to half of that. They run on the goroutine that queued
+	// or wrote the message without any melody lock held, so they may call
+	// back into melody.
+	SlowClientEnterHandler func(s *Session)
+	SlowClientLeaveHandler func(s *Session)
+
+	// IDGenerator returns the ID of a new session from its upgrade request,
+	// see Session.ID. It defaults to a process wide counter, also when nil.
+	IDGenerator func(r *http.Request) string
 }
 
 func newConfig() *Config {
 	return &Config{
-		WriteWait:         10 * time.Second,
-		PongWait:          60 * time.Second,
-		PingPeriod:        (60 * time.Second * 9) / 10,
-		MaxMessageSize:    512,
-		MessageBufferSize: 256,
+		WriteWait:           10 * time.Second,
+		PongWait:            60 * time.Second,
+		PingPeriod:          (60 * time.Second * 9) / 10,
+		MaxMessageSize:      512,
+		MessageBufferSize:   256,
+		InboundQueueSize:    256,
+		EchoPingPayload:     true,
+		PingSummaryInterval: time.Minute,
+		AckTimeout:          30 * time.Second,
+		AckFormat:           defaultAckFormat,
+		AckParse:            defaultAckParse,
+		ErrorReplyFormatter: defaultErrorReplyFormatter,
+		ErrorFormat:         defaultErrorFormat,
+		IDGenerator:         defaultIDGenerator,
+		Clock:               systemClock{},
+	}
+}
+
+// clock returns Clock, or the system clock if it isn't set.
+func (c *Config) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
+	}
+
+	return c.Clock
+}
+
+// idGenerator returns IDGenerator, or the default counter if it isn't set.
+func (c *Config) idGenerator() func(r *http.Request) string {
+	if c.IDGenerator == nil {
+		return defaultIDGenerator
+	}
+
+	return c.IDGenerator
+}
+
+// ackFormat returns AckFormat, or the default format if it isn't set.
+func (c *Config) ackFormat() func(id uint64, msg []byte) []byte {
+	if c.AckFormat == nil {
+		return defaultAckFormat
 	}
+
+	return c.AckFormat
+}
+
+// ackParse returns AckParse, or the default parser if it isn't set.
+func (c *Config) ackParse() func(msg []byte) (uint64, bool) {
+	if c.AckParse == nil {
+		return defaultAckParse
+	}
+
+	return c.AckParse
+}
+
+// errorReplyFormatter returns ErrorReplyFormatter, or the default one if it
+// isn't set.
+func (c *Config) errorReplyFormatter() func(err error) interface{} {
+	if c.ErrorReplyFormatter == nil {
+		return defaultErrorReplyFormatter
+	}
+
+	return c.ErrorReplyFormatter
+}
+
+// errorFormat returns ErrorFormat, or the default format if it isn't set.
+func (c *Config) errorFormat() func(code int, message string) []byte {
+	if c.ErrorFormat == nil {
+		return defaultErrorFormat
+	}
+
+	return c.ErrorFormat
+}
+
+// Validate reports whether the configuration can be used to serve sessions.
+// A PingPeriod that isn't positive is rejected, PingPeriod should also be
+// less than PongWait or sessions time out between pings. A negative
+// MaxMessageSize is rejected too.
+func (c *Config) Validate() error {
+	if c.PingPeriod <= 0 {
+		return ErrInvalidPingPeriod
+	}
+
+	if c.MaxMessageSize < 0 {
+		return ErrInvalidMaxMessageSize
+	}
+
+	return nil
 }
@@ -0,0 +1,23 @@
+package melody
+
+// Conn is the method set of Session that application code usually needs.
+// Handlers are still passed a *Session, which satisfies Conn, but code that
+// takes a Conn instead can be unit tested against a hand written fake.
+type Conn interface {
+	ID() string
+	Write(msg []byte) (int, error)
+	WriteText(msg []byte) error
+	WriteBinary(msg []byte) error
+	WriteJSON(v interface{}) error
+	Close() error
+	CloseWithMsg(msg []byte) error
+	Set(key string, value interface{})
+	Get(key string) (value interface{}, exists bool)
+	MustGet(key string) interface{}
+	Join(room string) error
+	Leave(room string)
+	IsClosed() bool
+	Done() <-chan struct{}
+}
+
+var _ Conn = (*Session)(nil)
@@ -1,7 +1,75 @@
 package melody
 
+import (
+	"context"
+	"sync"
+	"time"
+)
+
 type envelope struct {
-	t      int
-	msg    []byte
-	filter filterFunc
+	t           int
+	msg         []byte
+	filter      filterFunc
+	payload     payloadFunc // Builds msg for each session of a broadcast, if set.
+	room        string
+	tag         string
+	concurrency int        // Goroutines a broadcast to every session is split between.
+	deadline    time.Time  // Drop msg if it is still queued past deadline, if set.
+	flushed     chan error // Receives the result of writing msg to the connection, if set.
+	marker      bool       // Not a message, only reports on flushed once writePump reaches it.
+	pooled      bool       // Return to envelopePool once written, only for envelopes owned by one session.
+	compress    compression
+	ctx         context.Context // The context a broadcast was made with, if any.
+	meta        interface{}     // Passed on to SentMessage.Meta, see Session.WriteWithMeta.
+}
+
+// compression overrides write compression for a single envelope.
+type compression int8
+
+const (
+	compressDefault compression = iota
+	compressOn
+	compressOff
+)
+
+func compressionFor(compress bool) compression {
+	if compress {
+		return compressOn
+	}
+
+	return compressOff
+}
+
+var envelopePool = sync.Pool{
+	New: func() interface{} {
+		return &envelope{}
+	},
+}
+
+// newEnvelope gets an envelope from the pool. It must only be queued on a
+// single session, which releases it once written.
+func newEnvelope(t int, msg []byte) *envelope {
+	e := envelopePool.Get().(*envelope)
+	e.t = t
+	e.msg = msg
+	e.pooled = true
+	return e
+}
+
+// context returns the context the envelope was broadcast with, or
+// context.Background if there was none.
+func (e *envelope) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+
+	return e.ctx
+}
+
+// release returns a pooled envelope to the pool, dropping its reference to msg.
+func (e *envelope) release() {
+	if e.pooled {
+		*e = envelope{}
+		envelopePool.Put(e)
+	}
 }
@@ -0,0 +1,63 @@
+package melody
+
+import "sync/atomic"
+
+// HealthSnapshot is a point in time view of the load on a melody instance.
+type HealthSnapshot struct {
+	Sessions          int   // Connected sessions.
+	QueuedMessages    int   // Messages buffered across all sessions.
+	QueuedBytes       int64 // Bytes buffered across all sessions, see Config.MaxTotalBufferedBytes.
+	SlowSessions      int   // Sessions past Config.SlowClientThreshold, or if it isn't set that can't take another message, see Session.IsWritable.
+	PendingBroadcasts int   // Broadcasts waiting to be fanned out.
+	SkippedBroadcasts int64 // Broadcast deliveries dropped since start because a session's buffer was full, see Config.BroadcastSendTimeout.
+}
+
+// Health returns a snapshot of the load on the melody instance. It visits
+// every session under the hub lock, so it costs O(sessions).
+func (m *Melody) Health() HealthSnapshot {
+	h := m.hub
+
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	threshold := m.config().SlowClientThreshold
+
+	snapshot := HealthSnapshot{
+		Sessions:          len(h.sessions),
+		PendingBroadcasts: int(atomic.LoadInt64(&h.pending)),
+		SkippedBroadcasts: atomic.LoadInt64(&h.skipped),
+	}
+
+	for s := range h.sessions {
+		snapshot.QueuedMessages += len(s.output)
+		snapshot.QueuedBytes += s.QueuedBytes()
+		if threshold > 0 {
+			// Agree with the slow client handlers, see Session.checkSlow.
+			if atomic.LoadInt32(&s.slow) == 1 {
+				snapshot.SlowSessions++
+			}
+		} else if !s.IsWritable() {
+			snapshot.SlowSessions++
+		}
+	}
+
+	return snapshot
+}
+
+// SlowSessions returns the sessions that have more than threshold messages
+// waiting to be written, see Session.QueueLen.
+func (m *Melody) SlowSessions(threshold int) []*Session {
+	h := m.hub
+
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	var slow []*Session
+	for _, s := range h.order {
+		if s.QueueLen() > threshold {
+			slow = append(slow, s)
+		}
+	}
+
+	return slow
+}
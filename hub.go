@@ -1,28 +1,42 @@
 package melody
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type hub struct {
-	sessions   map[*Session]bool
-	broadcast  chan *envelope
-	register   chan *Session
-	unregister chan *Session
-	exit       chan *envelope
-	open       bool
-	rwmutex    *sync.RWMutex
+	pending   int64            // Broadcasts waiting on run, kept first for 64-bit alignment.
+	skipped   int64            // Broadcast deliveries dropped on a full buffer.
+	sessions  map[*Session]int // Index of each session in order.
+	order     []*Session
+	next      int // Where the next broadcast starts in order.
+	rooms     map[string]map[*Session]bool
+	ranks     map[string]map[*Session]int // Priority of the room members that joined with one.
+	tags      map[string]map[*Session]bool
+	ips       map[string]int // Admitted connections of each remote IP.
+	admitted  int
+	broadcast chan *envelope
+	exit      chan *envelope
+	done      chan struct{}
+	last      []*Session // Sessions connected when the hub closed, set before done is closed.
+	open      bool
+	rwmutex   *sync.RWMutex
 }
 
 func newHub() *hub {
 	return &hub{
-		sessions:   make(map[*Session]bool),
-		broadcast:  make(chan *envelope),
-		register:   make(chan *Session),
-		unregister: make(chan *Session),
-		exit:       make(chan *envelope),
-		open:       true,
-		rwmutex:    &sync.RWMutex{},
+		sessions:  make(map[*Session]int),
+		rooms:     make(map[string]map[*Session]bool),
+		ranks:     make(map[string]map[*Session]int),
+		tags:      make(map[string]map[*Session]bool),
+		ips:       make(map[string]int),
+		broadcast: make(chan *envelope),
+		exit:      make(chan *envelope),
+		done:      make(chan struct{}),
+		open:      true,
+		rwmutex:   &sync.RWMutex{},
 	}
 }
 
@@ -30,42 +44,505 @@ func (h *hub) run() {
 loop:
 	for {
 		select {
-		case s := <-h.register:
-			h.rwmutex.Lock()
-			h.sessions[s] = true
-			h.rwmutex.Unlock()
-		case s := <-h.unregister:
-			if _, ok := h.sessions[s]; ok {
-				h.rwmutex.Lock()
-				delete(h.sessions, s)
-				h.rwmutex.Unlock()
-			}
 		case m := <-h.broadcast:
-			h.rwmutex.RLock()
-			for s := range h.sessions {
-				if m.filter != nil {
-					if m.filter(s) {
-						s.writeMessage(m)
-					}
-				} else {
-					s.writeMessage(m)
-				}
-			}
-			h.rwmutex.RUnlock()
+			// Deliver outside the lock, a session waiting out
+			// Config.BroadcastSendTimeout must not hold up add and remove.
+			h.fanout(m, h.recipients(m))
 		case m := <-h.exit:
 			h.rwmutex.Lock()
-			for s := range h.sessions {
+			last := h.order
+			h.last = last
+			h.sessions = make(map[*Session]int)
+			h.order = nil
+			h.open = false
+			h.rwmutex.Unlock()
+
+			// Write outside the lock, queueing can fire handlers that call
+			// back into the hub, see Config.SlowClientEnterHandler.
+			for _, s := range last {
+				s.setReason(DisconnectServerClose)
 				s.writeMessage(m)
-				delete(h.sessions, s)
 				s.Close()
 			}
-			h.open = false
-			h.rwmutex.Unlock()
+			close(h.done)
 			break loop
 		}
 	}
 }
 
+func (h *hub) add(s *Session) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	if !h.open {
+		return false
+	}
+
+	h.sessions[s] = len(h.order)
+	h.order = append(h.order, s)
+
+	return true
+}
+
+// admit reserves a connection slot for ip, see Config.MaxConnections and
+// Config.FairAdmission. Every admitted ip must be released.
+func (h *hub) admit(ip string, max int, fair bool) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	if max > 0 {
+		if h.admitted >= max {
+			return false
+		}
+
+		// Past half of capacity an ip may only hold its fair share of it.
+		if fair && h.admitted*2 >= max && h.ips[ip] > 0 && h.ips[ip] >= max/len(h.ips) {
+			return false
+		}
+	}
+
+	h.admitted++
+	h.ips[ip]++
+
+	return true
+}
+
+func (h *hub) release(ip string) {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	h.admitted--
+	h.ips[ip]--
+	if h.ips[ip] <= 0 {
+		delete(h.ips, ip)
+	}
+}
+
+func (h *hub) remove(s *Session) {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	i, ok := h.sessions[s]
+	if !ok {
+		return
+	}
+
+	// Move the last session into the gap rather than shifting the rest down,
+	// see Melody.Broadcast.
+	last := len(h.order) - 1
+	h.order[i] = h.order[last]
+	h.sessions[h.order[i]] = i
+	h.order[last] = nil
+	h.order = h.order[:last]
+	delete(h.sessions, s)
+}
+
+// recipients returns a copy of the sessions m is broadcast to, in the order
+// they are served.
+func (h *hub) recipients(m *envelope) []*Session {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	if m.room != "" {
+		ranks := h.ranks[m.room]
+		sessions := rankedMembers(ranks)
+		for s := range h.rooms[m.room] {
+			if _, ranked := ranks[s]; !ranked {
+				sessions = append(sessions, s)
+			}
+		}
+		return sessions
+	}
+
+	if m.tag != "" {
+		sessions := make([]*Session, 0, len(h.tags[m.tag]))
+		for s := range h.tags[m.tag] {
+			sessions = append(sessions, s)
+		}
+		return sessions
+	}
+
+	n := len(h.order)
+	if n == 0 {
+		return nil
+	}
+
+	// Start each broadcast one session further along so no session is
+	// always served last.
+	start := h.next % n
+	h.next = start + 1
+
+	sessions := make([]*Session, n)
+	for i := range sessions {
+		sessions[i] = h.order[(start+i)%n]
+	}
+	return sessions
+}
+
+// fanout delivers m to sessions in turn. With m.concurrency above one the
+// sessions are split between that many goroutines, fanout returns once all
+// of them are done.
+func (h *hub) fanout(m *envelope, sessions []*Session) {
+	n := len(sessions)
+	workers := m.concurrency
+	if workers > n {
+		workers = n
+	}
+
+	if workers <= 1 {
+		for _, s := range sessions {
+			h.deliver(s, m)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for from := 0; from < n; from += chunk {
+		to := from + chunk
+		if to > n {
+			to = n
+		}
+
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			for _, s := range sessions[from:to] {
+				h.deliver(s, m)
+			}
+		}(from, to)
+	}
+	wg.Wait()
+}
+
+// deliver queues a broadcast message on s if it passes the message filter,
+// building its payload for s first if the broadcast has one per session.
+// Sessions that closed since recipients was taken are passed over.
+func (h *hub) deliver(s *Session, m *envelope) {
+	if s.closed() {
+		return
+	}
+
+	if m.filter != nil && !m.filter(s) {
+		return
+	}
+
+	if m.payload != nil {
+		msg, ok := m.payload(s)
+		if !ok {
+			return
+		}
+
+		m = &envelope{t: m.t, msg: msg, ctx: m.ctx}
+	}
+
+	switch s.writeMessageTimeout(m, s.melody.config().BroadcastSendTimeout) {
+	case ErrMessageBufferFull, ErrTotalBufferFull:
+		atomic.AddInt64(&h.skipped, 1)
+	}
+}
+
+func (h *hub) send(m *envelope) error {
+	atomic.AddInt64(&h.pending, 1)
+	defer atomic.AddInt64(&h.pending, -1)
+
+	select {
+	case h.broadcast <- m:
+		return nil
+	case <-h.done:
+		return ErrMelodyClosed
+	}
+}
+
+func (h *hub) close(m *envelope) error {
+	select {
+	case h.exit <- m:
+		return nil
+	case <-h.done:
+		return ErrMelodyAlreadyClosed
+	}
+}
+
+func (h *hub) reconfigure() {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	for s := range h.sessions {
+		select {
+		case s.reconfigure <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (h *hub) join(s *Session, room string) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	return h.joinLocked(s, room)
+}
+
+// joinLocked adds s to room, the hub lock must be held.
+func (h *hub) joinLocked(s *Session, room string) bool {
+	if s.closed() {
+		return false
+	}
+
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*Session]bool)
+		h.rooms[room] = members
+	}
+	members[s] = true
+
+	return true
+}
+
+// joinPriority adds s to room like join, recording priority for it. Priority
+// members are delivered room broadcasts first, highest priority first.
+func (h *hub) joinPriority(s *Session, room string, priority int) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	if !h.joinLocked(s, room) {
+		return false
+	}
+
+	ranks, ok := h.ranks[room]
+	if !ok {
+		ranks = make(map[*Session]int)
+		h.ranks[room] = ranks
+	}
+	ranks[s] = priority
+
+	return true
+}
+
+// byPriority sorts sessions by descending priority.
+type byPriority struct {
+	sessions []*Session
+	ranks    map[*Session]int
+}
+
+func (p byPriority) Len() int           { return len(p.sessions) }
+func (p byPriority) Swap(i, j int)      { p.sessions[i], p.sessions[j] = p.sessions[j], p.sessions[i] }
+func (p byPriority) Less(i, j int) bool { return p.ranks[p.sessions[i]] > p.ranks[p.sessions[j]] }
+
+// rankedMembers returns the sessions in ranks, highest priority first.
+func rankedMembers(ranks map[*Session]int) []*Session {
+	if len(ranks) == 0 {
+		return nil
+	}
+
+	sessions := make([]*Session, 0, len(ranks))
+	for s := range ranks {
+		sessions = append(sessions, s)
+	}
+	sort.Sort(byPriority{sessions: sessions, ranks: ranks})
+
+	return sessions
+}
+
+// unrank forgets the priority of s in room, the hub lock must be held.
+func (h *hub) unrank(s *Session, room string) {
+	if ranks, ok := h.ranks[room]; ok {
+		delete(ranks, s)
+		if len(ranks) == 0 {
+			delete(h.ranks, room)
+		}
+	}
+}
+
+// leave removes s from room and reports whether room became empty.
+func (h *hub) leave(s *Session, room string) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	members, ok := h.rooms[room]
+	if !ok || !members[s] {
+		return false
+	}
+
+	delete(members, s)
+	h.unrank(s, room)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		return true
+	}
+
+	return false
+}
+
+// leaveAll removes s from every room and returns the rooms that became empty.
+func (h *hub) leaveAll(s *Session) []string {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	var empty []string
+	for room, members := range h.rooms {
+		if !members[s] {
+			continue
+		}
+
+		delete(members, s)
+		h.unrank(s, room)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+			empty = append(empty, room)
+		}
+	}
+
+	return empty
+}
+
+// closeRoom removes room and returns its members.
+func (h *hub) closeRoom(room string) []*Session {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	members := h.rooms[room]
+	delete(h.rooms, room)
+	delete(h.ranks, room)
+
+	sessions := make([]*Session, 0, len(members))
+	for s := range members {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+func (h *hub) sessionRooms(s *Session) []string {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	rooms := []string{}
+	for room, members := range h.rooms {
+		if members[s] {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms
+}
+
+func (h *hub) roomSessions(room string) []*Session {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	members := h.rooms[room]
+	sessions := make([]*Session, 0, len(members))
+	for s := range members {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+func (h *hub) roomNames() []string {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	rooms := make([]string, 0, len(h.rooms))
+	for room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+// allRooms returns a snapshot of every room and its members taken under a
+// single lock.
+func (h *hub) allRooms() map[string][]*Session {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	rooms := make(map[string][]*Session, len(h.rooms))
+	for room, members := range h.rooms {
+		sessions := make([]*Session, 0, len(members))
+		for s := range members {
+			sessions = append(sessions, s)
+		}
+		rooms[room] = sessions
+	}
+
+	return rooms
+}
+
+func (h *hub) roomLen(room string) int {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	return len(h.rooms[room])
+}
+
+func (h *hub) addTag(s *Session, tag string) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	if s.closed() {
+		return false
+	}
+
+	tagged, ok := h.tags[tag]
+	if !ok {
+		tagged = make(map[*Session]bool)
+		h.tags[tag] = tagged
+	}
+	tagged[s] = true
+
+	return true
+}
+
+func (h *hub) removeTag(s *Session, tag string) {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	tagged := h.tags[tag]
+	delete(tagged, s)
+	if len(tagged) == 0 {
+		delete(h.tags, tag)
+	}
+}
+
+func (h *hub) removeAllTags(s *Session) {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	for tag, tagged := range h.tags {
+		delete(tagged, s)
+		if len(tagged) == 0 {
+			delete(h.tags, tag)
+		}
+	}
+}
+
+func (h *hub) sessionTags(s *Session) []string {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	tags := []string{}
+	for tag, tagged := range h.tags {
+		if tagged[s] {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func (h *hub) all() []*Session {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
 func (h *hub) closed() bool {
 	h.rwmutex.RLock()
 	defer h.rwmutex.RUnlock()
@@ -78,3 +555,18 @@ func (h *hub) len() int {
 
 	return len(h.sessions)
 }
+
+func (h *hub) lenByState() (open, closing int) {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	for s := range h.sessions {
+		if s.DisconnectReason() == DisconnectUnknown {
+			open++
+		} else {
+			closing++
+		}
+	}
+
+	return open, closing
+}
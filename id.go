@@ -0,0 +1,15 @@
+package melody
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var lastSessionID uint64
+
+// defaultIDGenerator numbers sessions with a process wide counter, ie: "1",
+// "2", "3".
+func defaultIDGenerator(*http.Request) string {
+	return strconv.FormatUint(atomic.AddUint64(&lastSessionID, 1), 10)
+}
@@ -0,0 +1,171 @@
+package melody
+
+import "sync"
+
+type inboundMessage struct {
+	t   int
+	msg []byte
+}
+
+// inboundQueue buffers messages read from a session until a worker of the
+// melody instance's pool dispatches them. At most one worker drains a session
+// at a time, so its messages are handled in the order they were read.
+type inboundQueue struct {
+	messages  chan inboundMessage
+	mutex     sync.Mutex
+	scheduled bool
+}
+
+func newInboundQueue(size int) *inboundQueue {
+	return &inboundQueue{
+		messages: make(chan inboundMessage, size),
+	}
+}
+
+func (q *inboundQueue) push(s *Session, t int, msg []byte) {
+	select {
+	case q.messages <- inboundMessage{t: t, msg: msg}:
+	default:
+		s.melody.errorHandler(s, ErrInboundQueueFull)
+		return
+	}
+
+	q.mutex.Lock()
+	schedule := !q.scheduled
+	q.scheduled = true
+	q.mutex.Unlock()
+
+	if schedule {
+		s.melody.workers.schedule(s)
+	}
+}
+
+// run dispatches queued messages until the queue is empty.
+func (q *inboundQueue) run(s *Session) {
+	for {
+		select {
+		case m := <-q.messages:
+			s.dispatch(m.t, m.msg)
+			continue
+		default:
+		}
+
+		q.mutex.Lock()
+		if len(q.messages) == 0 {
+			q.scheduled = false
+			q.mutex.Unlock()
+			return
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// workerPool is a group of goroutines dispatching inbound messages for all
+// sessions. It grows to the largest size it was started with and stops once
+// the melody instance has shut down.
+type workerPool struct {
+	mutex   sync.RWMutex
+	tasks   chan *Session
+	size    int
+	stopped bool
+}
+
+// start grows the pool to n workers, a smaller n leaves it as it is.
+func (p *workerPool) start(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	if p.tasks == nil {
+		p.tasks = make(chan *Session, n)
+	}
+
+	for ; p.size < n; p.size++ {
+		go func() {
+			for s := range p.tasks {
+				s.inbound.run(s)
+			}
+		}()
+	}
+}
+
+// schedule hands s to a worker, unless the pool has stopped.
+func (p *workerPool) schedule(s *Session) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if !p.stopped {
+		p.tasks <- s
+	}
+}
+
+// stop ends the workers once they have dispatched what was scheduled.
+func (p *workerPool) stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.stopped && p.tasks != nil {
+		close(p.tasks)
+	}
+	p.stopped = true
+}
+
+// ReadBufferPolicy decides what happens when a session reads a message while
+// its Config.ReadBufferMessages buffer is full.
+type ReadBufferPolicy int
+
+// Policies for a full read buffer.
+const (
+	ReadBufferBlock      ReadBufferPolicy = iota // Stop reading from the session until its handler catches up.
+	ReadBufferDisconnect                         // Close the session with CloseTryAgainLater.
+)
+
+// readBuffer decouples reading a session from handling its messages. A single
+// goroutine drains it, so messages are handled in the order they were read.
+type readBuffer struct {
+	messages chan inboundMessage
+	policy   ReadBufferPolicy
+	done     chan struct{}
+}
+
+func newReadBuffer(size int, policy ReadBufferPolicy) *readBuffer {
+	return &readBuffer{
+		messages: make(chan inboundMessage, size),
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+}
+
+// push buffers a message and reports whether there was room for it.
+func (b *readBuffer) push(t int, msg []byte) bool {
+	m := inboundMessage{t: t, msg: msg}
+
+	if b.policy == ReadBufferBlock {
+		b.messages <- m
+		return true
+	}
+
+	select {
+	case b.messages <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *readBuffer) run(s *Session) {
+	defer close(b.done)
+
+	for m := range b.messages {
+		s.dispatch(m.t, m.msg)
+	}
+}
+
+// stop waits for the messages already buffered to be handled.
+func (b *readBuffer) stop() {
+	close(b.messages)
+	<-b.done
+}
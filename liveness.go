@@ -0,0 +1,48 @@
+package melody
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PingSummary counts the ping traffic of all sessions over one
+// Config.PingSummaryInterval, see HandlePingSummary.
+type PingSummary struct {
+	Pings    int64         // Pings written to sessions.
+	Pongs    int64         // Pongs read from sessions.
+	Interval time.Duration // The period the counts cover.
+}
+
+// HandlePingSummary fires fn every Config.PingSummaryInterval with the number
+// of pings and pongs exchanged with all sessions since the last call. Unlike
+// HandlePong it fires once per interval rather than once per pong, so it stays
+// cheap to log with many sessions. The interval is read when fn is first set.
+func (m *Melody) HandlePingSummary(fn func(PingSummary)) {
+	m.pingSummaryHandler.Store(fn)
+	m.pingSummaryOnce.Do(func() {
+		go m.summarizePings(m.config().PingSummaryInterval)
+	})
+}
+
+func (m *Melody) summarizePings(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := m.config().clock().NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			fn := m.pingSummaryHandler.Load().(func(PingSummary))
+			fn(PingSummary{
+				Pings:    atomic.SwapInt64(&m.pings, 0),
+				Pongs:    atomic.SwapInt64(&m.pongs, 0),
+				Interval: interval,
+			})
+		case <-m.hub.done:
+			return
+		}
+	}
+}
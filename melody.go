@@ -3,15 +3,25 @@ package melody
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
+	// ErrMelodyClosed is returned by HandleRequest and the broadcast methods
+	// once the melody instance has been closed.
 	ErrMelodyClosed        = errors.New("melody instance is closed")
 	ErrMelodyAlreadyClosed = errors.New("melody instance is already closed")
+	ErrCloseTimeout        = errors.New("melody instance sessions did not close in time")
+	ErrTooManyConnections  = errors.New("melody instance is not admitting more connections")
+	ErrConfigInUse         = errors.New("melody instance config is in use by sessions")
 )
 
 type contextKey string
@@ -63,22 +73,59 @@ type handleMessageFunc func(*Session, []byte)
 type handleErrorFunc func(*Session, error)
 type handleCloseFunc func(*Session, int, string) error
 type handleSessionFunc func(*Session)
+type handleAckFunc func(*Session, uint64)
+type handleRoomFunc func(string)
+type handleUpgradeFunc func(http.ResponseWriter, *http.Request) error
+type handleReaderFunc func(*Session, int, io.Reader)
+type handleRateFunc func(*Session, float64)
+type handlePresenceFunc func(string)
+type handleSentFunc func(*Session, SentMessage)
 type filterFunc func(*Session) bool
+type payloadFunc func(*Session) ([]byte, bool)
 
 // Melody implements a websocket manager.
+// Config must not be mutated once HandleRequest has been called. Use
+// Configure to change it before that, or UpdateConfig to replace it
+// afterwards, sessions read it under a lock that UpdateConfig takes.
 type Melody struct {
+	buffered                 int64 // Bytes buffered across all sessions, kept first for 64-bit alignment.
+	pings                    int64 // Pings written since the last ping summary.
+	pongs                    int64 // Pongs read since the last ping summary.
+	served                   int32 // Set once HandleRequest has been called.
 	Config                   *Config
 	Upgrader                 *websocket.Upgrader
 	messageHandler           handleMessageFunc
 	messageHandlerBinary     handleMessageFunc
 	messageSentHandler       handleMessageFunc
 	messageSentHandlerBinary handleMessageFunc
+	sentInfoHandler          handleSentFunc
 	errorHandler             handleErrorFunc
 	closeHandler             handleCloseFunc
 	connectHandler           handleSessionFunc
 	disconnectHandler        handleSessionFunc
 	pongHandler              handleSessionFunc
+	ackHandler               handleAckFunc
+	ackTimeoutHandler        handleAckFunc
+	roomEmptyHandler         handleRoomFunc
+	beforeUpgradeHandler     handleUpgradeFunc
+	events                   map[string]handleEventFunc
+	binaryEvents             map[string]binaryEvent
+	middleware               []Middleware
+	protocolHandlers         map[string]handleMessageFunc
+	protocolHandlersBinary   map[string]handleMessageFunc
+	messageReaderHandler     handleReaderFunc
+	rateExceededHandler      handleRateFunc
+	onlineHandler            handlePresenceFunc
+	offlineHandler           handlePresenceFunc
 	hub                      *hub
+	workers                  *workerPool
+	presence                 *presence
+	shutdownHooks            []func()
+	shutdownMutex            sync.Mutex
+	configMutex              sync.RWMutex // Guards Config against UpdateConfig.
+	pingSummaryHandler       atomic.Value
+	pingSummaryOnce          sync.Once
+	startedAt                time.Time
 }
 
 // New creates a new melody instance with default Upgrader and Config.
@@ -90,25 +137,44 @@ func New() *Melody {
 	}
 
 	hub := newHub()
+	config := newConfig()
 
 	go hub.run()
 
 	return &Melody{
-		Config:                   newConfig(),
+		Config:                   config,
 		Upgrader:                 upgrader,
 		messageHandler:           func(*Session, []byte) {},
 		messageHandlerBinary:     func(*Session, []byte) {},
 		messageSentHandler:       func(*Session, []byte) {},
 		messageSentHandlerBinary: func(*Session, []byte) {},
+		sentInfoHandler:          func(*Session, SentMessage) {},
 		errorHandler:             func(*Session, error) {},
 		closeHandler:             nil,
 		connectHandler:           func(*Session) {},
 		disconnectHandler:        func(*Session) {},
 		pongHandler:              func(*Session) {},
+		ackHandler:               func(*Session, uint64) {},
+		ackTimeoutHandler:        func(*Session, uint64) {},
+		roomEmptyHandler:         func(string) {},
+		beforeUpgradeHandler:     func(http.ResponseWriter, *http.Request) error { return nil },
+		rateExceededHandler:      func(*Session, float64) {},
+		onlineHandler:            func(string) {},
+		offlineHandler:           func(string) {},
 		hub:                      hub,
+		workers:                  &workerPool{},
+		presence:                 newPresence(),
+		startedAt:                config.Clock.Now(),
 	}
 }
 
+// HandleBeforeUpgrade fires fn before a request is upgraded to a websocket
+// connection. If fn returns an error the upgrade is aborted and HandleRequest
+// returns the error, fn is then responsible for writing the HTTP response.
+func (m *Melody) HandleBeforeUpgrade(fn func(http.ResponseWriter, *http.Request) error) {
+	m.beforeUpgradeHandler = fn
+}
+
 // HandleConnect fires fn when a session connects.
 func (m *Melody) HandleConnect(fn func(*Session)) {
 	m.connectHandler = fn
@@ -124,16 +190,122 @@ func (m *Melody) HandlePong(fn func(*Session)) {
 	m.pongHandler = fn
 }
 
+// HandleAck fires fn when a session acknowledges a message sent with WriteReliable.
+func (m *Melody) HandleAck(fn func(*Session, uint64)) {
+	m.ackHandler = fn
+}
+
+// HandleAckTimeout fires fn when a message sent with WriteReliable is not
+// acknowledged within Config.AckTimeout. It doesn't fire for messages still
+// waiting when the session disconnects.
+func (m *Melody) HandleAckTimeout(fn func(*Session, uint64)) {
+	m.ackTimeoutHandler = fn
+}
+
+// HandleRoomEmpty fires fn when the last session leaves a room.
+func (m *Melody) HandleRoomEmpty(fn func(string)) {
+	m.roomEmptyHandler = fn
+}
+
+// HandleRateExceeded fires fn with the observed rate in messages per second
+// when a session sends more than Config.MaxMessagesPerSecond. The session has
+// already been closed with a policy violation close code when fn fires.
+func (m *Melody) HandleRateExceeded(fn func(*Session, float64)) {
+	m.rateExceededHandler = fn
+}
+
+// HandleOnline fires fn with an identity when its first session connects,
+// see Config.PresenceKey. The identity is read once HandleConnect returns.
+func (m *Melody) HandleOnline(fn func(string)) {
+	m.onlineHandler = fn
+}
+
+// HandleOffline fires fn with an identity when its last session disconnects.
+// With Config.PresenceDebounce it only fires if no session of the identity
+// reconnects within the debounce, and then the matching HandleOnline doesn't
+// fire either.
+func (m *Melody) HandleOffline(fn func(string)) {
+	m.offlineHandler = fn
+}
+
 // HandleMessage fires fn when a text message comes in.
+// It replaces every handler added with AddMessageHandler.
 func (m *Melody) HandleMessage(fn func(*Session, []byte)) {
 	m.messageHandler = fn
 }
 
+// AddMessageHandler adds fn to the handlers fired when a text message comes
+// in. Handlers fire in the order they were added, starting with the one set
+// by HandleMessage, and every handler sees every message.
+func (m *Melody) AddMessageHandler(fn func(*Session, []byte)) {
+	m.messageHandler = chainMessageHandlers(m.messageHandler, fn)
+}
+
 // HandleMessageBinary fires fn when a binary message comes in.
+// It replaces every handler added with AddMessageHandlerBinary.
 func (m *Melody) HandleMessageBinary(fn func(*Session, []byte)) {
 	m.messageHandlerBinary = fn
 }
 
+// AddMessageHandlerBinary is like AddMessageHandler but for binary messages.
+func (m *Melody) AddMessageHandlerBinary(fn func(*Session, []byte)) {
+	m.messageHandlerBinary = chainMessageHandlers(m.messageHandlerBinary, fn)
+}
+
+// HandleMessageForProtocol fires fn instead of the HandleMessage handler when
+// a text message comes in from a session that negotiated subprotocol proto.
+// A handler set with Session.SetMessageHandler still takes precedence.
+func (m *Melody) HandleMessageForProtocol(proto string, fn func(*Session, []byte)) {
+	if m.protocolHandlers == nil {
+		m.protocolHandlers = make(map[string]handleMessageFunc)
+	}
+
+	m.protocolHandlers[proto] = fn
+}
+
+// HandleMessageBinaryForProtocol is like HandleMessageForProtocol but for
+// binary messages.
+func (m *Melody) HandleMessageBinaryForProtocol(proto string, fn func(*Session, []byte)) {
+	if m.protocolHandlersBinary == nil {
+		m.protocolHandlersBinary = make(map[string]handleMessageFunc)
+	}
+
+	m.protocolHandlersBinary[proto] = fn
+}
+
+// protocolHandler returns the handler in handlers for the subprotocol of s,
+// or fallback if there is none.
+func (m *Melody) protocolHandler(handlers map[string]handleMessageFunc, fallback handleMessageFunc, s *Session) handleMessageFunc {
+	if len(handlers) == 0 {
+		return fallback
+	}
+
+	if fn, ok := handlers[s.Subprotocol()]; ok {
+		return fn
+	}
+
+	return fallback
+}
+
+func chainMessageHandlers(first, next handleMessageFunc) handleMessageFunc {
+	return func(s *Session, msg []byte) {
+		first(s, msg)
+		next(s, msg)
+	}
+}
+
+// HandleMessageReader fires fn with a reader for every incoming message, text
+// or binary, instead of buffering the whole message first. Reads return data
+// as its frames arrive, so a message sent in many frames can be consumed
+// while it is still being received. Frame boundaries themselves are not
+// visible, and with compression the reader yields the decompressed stream
+// which spans frames. The reader is only valid until fn returns, whatever is
+// left unread is discarded. When set, HandleMessage, HandleMessageBinary,
+// On, WriteReliable acknowledgements and Config.InboundWorkers are bypassed.
+func (m *Melody) HandleMessageReader(fn func(*Session, int, io.Reader)) {
+	m.messageReaderHandler = fn
+}
+
 // HandleSentMessage fires fn when a text message is successfully sent.
 func (m *Melody) HandleSentMessage(fn func(*Session, []byte)) {
 	m.messageSentHandler = fn
@@ -144,6 +316,27 @@ func (m *Melody) HandleSentMessageBinary(fn func(*Session, []byte)) {
 	m.messageSentHandlerBinary = fn
 }
 
+// SentMessage describes a message written to a session, see HandleSentMessageInfo.
+type SentMessage struct {
+	Type      int    // The message type, ie: websocket.TextMessage.
+	Msg       []byte // The message payload.
+	WireBytes int64  // Bytes written to the connection for the message, framing and compression included.
+
+	// Context is the context the message was broadcast with, see BroadcastCtx.
+	// It is context.Background for messages without one.
+	Context context.Context
+
+	// Meta is the metadata the message was written with, see
+	// Session.WriteWithMeta. It is nil for messages without any.
+	Meta interface{}
+}
+
+// HandleSentMessageInfo fires fn when a text or binary message is
+// successfully sent, along with its type and size on the wire.
+func (m *Melody) HandleSentMessageInfo(fn func(*Session, SentMessage)) {
+	m.sentInfoHandler = fn
+}
+
 // HandleError fires fn when a session has an error.
 func (m *Melody) HandleError(fn func(*Session, error)) {
 	m.errorHandler = fn
@@ -168,96 +361,330 @@ func (m *Melody) HandleClose(fn func(*Session, int, string) error) {
 	}
 }
 
+// HandleCloseReply is like HandleClose but fn decides the close frame sent
+// back to the session. If fn returns true for sendClose a close frame with
+// code and reason is sent, otherwise no close frame is sent back. It
+// replaces the handler set by HandleClose.
+func (m *Melody) HandleCloseReply(fn func(s *Session, code int, text string) (sendClose bool, replyCode int, reason string)) {
+	m.closeHandler = func(s *Session, code int, text string) error {
+		if sendClose, replyCode, reason := fn(s, code, text); sendClose {
+			s.writeControl(websocket.CloseMessage, FormatCloseMessage(replyCode, reason))
+		}
+
+		return nil
+	}
+}
+
 // HandleRequest upgrades http requests to websocket connections and dispatches them to be handled by the melody instance.
 func (m *Melody) HandleRequest(w http.ResponseWriter, r *http.Request) error {
+	return m.handleRequest(w, r, nil, "")
+}
+
+// HandleRequestRoom does the same as HandleRequest but joins the session to
+// the room returned by roomFromPath, ie: the {id} of a /ws/room/{id} route.
+// The session joins before the HandleConnect handler fires, so it can already
+// broadcast to the room. An empty room joins none.
+func (m *Melody) HandleRequestRoom(w http.ResponseWriter, r *http.Request, roomFromPath func(*http.Request) string) error {
+	return m.handleRequest(w, r, nil, roomFromPath(r))
+}
+
+// HandleRequestWithContext does the same as HandleRequestWithKeys but uses ctx
+// as the context of the session request in place of the request's own. The
+// session is closed when ctx is done, so cancelling a context shared by many
+// sessions closes all of them.
+func (m *Melody) HandleRequestWithContext(ctx context.Context, w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
+	return m.handleRequest(w, newRequestWithContextKeys(r.WithContext(ctx), keys), ctx.Done(), "")
+}
+
+// handleRequest serves a session for r, closing it once cancel is closed. The
+// session joins room before it is announced, unless room is empty.
+func (m *Melody) handleRequest(w http.ResponseWriter, r *http.Request, cancel <-chan struct{}, room string) error {
+	atomic.StoreInt32(&m.served, 1)
+
 	if m.hub.closed() {
 		return ErrMelodyClosed
 	}
 
-	conn, err := m.Upgrader.Upgrade(w, r, nil)
+	if err := m.config().Validate(); err != nil {
+		return m.refuse(w, r, http.StatusInternalServerError, err)
+	}
+
+	if err := m.beforeUpgradeHandler(w, r); err != nil {
+		return err
+	}
+
+	ip := remoteIP(r)
+	if !m.hub.admit(ip, m.config().MaxConnections, m.config().FairAdmission) {
+		return m.refuse(w, r, http.StatusServiceUnavailable, ErrTooManyConnections)
+	}
+	defer m.hub.release(ip)
+
+	upgrader := m.Upgrader
+	if m.config().UpgradeErrorHandler != nil {
+		u := *m.Upgrader
+		u.Error = m.config().UpgradeErrorHandler
+		upgrader = &u
+	}
+
+	wire := &wireCounter{}
+	conn, err := upgrader.Upgrade(countWire(w, wire), r, nil)
 
 	if err != nil {
 		return err
 	}
 
 	session := &Session{
+		id:      m.config().idGenerator()(r),
 		Request: r,
 		conn:    conn,
-		output:  make(chan *envelope, m.Config.MessageBufferSize),
+		output:  make(chan *envelope, m.config().MessageBufferSize),
 		melody:  m,
 		open:    true,
 		rwmutex: &sync.RWMutex{},
+		acks:    newAckTracker(),
+		wire:    wire,
+		tls:     r.TLS,
+
+		compression: upgrader.EnableCompression && offersCompression(r),
+		reconfigure: make(chan struct{}, 1),
+		active:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		finished:    make(chan struct{}),
+		connectedAt: m.config().clock().Now(),
 	}
 
-	m.hub.register <- session
+	if m.config().InboundWorkers > 0 {
+		m.workers.start(m.config().InboundWorkers)
+		session.inbound = newInboundQueue(m.config().InboundQueueSize)
+	} else if m.config().ReadBufferMessages > 0 {
+		session.reads = newReadBuffer(m.config().ReadBufferMessages, m.config().ReadBufferPolicy)
+	}
+
+	if !m.hub.add(session) {
+		conn.Close()
+		return ErrMelodyClosed
+	}
+
+	if room != "" {
+		session.Join(room)
+	}
 
 	m.connectHandler(session)
 
-	go session.writePump()
+	identity, present := m.identity(session)
+	if present && m.presence.connect(identity) {
+		m.onlineHandler(identity)
+	}
+
+	var lifetime Timer
+	if d := m.config().MaxConnectionLifetime; d > 0 {
+		lifetime = m.config().clock().AfterFunc(d, session.lifetimeExceeded)
+	}
+
+	if cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				// Like CloseAllWithMsg, a full buffer must not keep the
+				// session open.
+				session.setReason(DisconnectKicked)
+				session.closeNow(FormatCloseMessage(CloseNormalClosure, ""))
+			case <-session.done:
+			}
+		}()
+	}
+
+	go func() {
+		session.writePump()
+		close(session.stopped)
+	}()
 
-	session.readPump()
+	err = session.readPump()
 
-	if !m.hub.closed() {
-		m.hub.unregister <- session
+	if lifetime != nil {
+		lifetime.Stop()
 	}
 
+	if m.config().DrainOnClose && m.closeHandler == nil {
+		session.drain(err)
+	}
+
+	m.hub.remove(session)
+
 	session.close()
+	session.acks.stop()
+
+	for _, room := range m.hub.leaveAll(session) {
+		m.roomEmptyHandler(room)
+	}
+
+	m.hub.removeAllTags(session)
 
 	m.disconnectHandler(session)
 
+	if present && m.presence.disconnect(identity, m.config().clock(), m.config().PresenceDebounce, m.offlineHandler) {
+		m.offlineHandler(identity)
+	}
+
+	<-session.stopped
+	session.unreserveAll()
+	close(session.finished)
+
 	return nil
 }
 
+// refuse writes an HTTP response with status for a request that won't be
+// upgraded, through Config.UpgradeErrorHandler if it is set, and returns err.
+func (m *Melody) refuse(w http.ResponseWriter, r *http.Request, status int, err error) error {
+	if handler := m.config().UpgradeErrorHandler; handler != nil {
+		handler(w, r, status, err)
+	} else {
+		http.Error(w, http.StatusText(status), status)
+	}
+
+	return err
+}
+
+// offersCompression reports whether r offers the permessage-deflate
+// extension, which the upgrader accepts when its EnableCompression is set.
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(header, ",") {
+			if strings.TrimSpace(strings.SplitN(ext, ";", 2)[0]) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// remoteIP returns the IP of the client that sent r, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// identity returns the presence identity of session, if it has one.
+func (m *Melody) identity(session *Session) (string, bool) {
+	if m.config().PresenceKey == "" {
+		return "", false
+	}
+
+	value, _ := session.Get(m.config().PresenceKey)
+	identity, ok := value.(string)
+
+	return identity, ok
+}
+
+// keyNamesKey holds the names of every key stored on a request, so they can
+// be listed by Session.Export.
+type keyNamesKey struct{}
+
 func newRequestWithContextKey(r *http.Request, key string, value interface{}) *http.Request {
-	return r.WithContext(context.WithValue(r.Context(), contextKey(key), value))
+	ctx := withKeyNames(r.Context(), key)
+	return r.WithContext(context.WithValue(ctx, contextKey(key), value))
 }
 
 func newRequestWithContextKeys(r *http.Request, keys map[string]interface{}) *http.Request {
-	var ctx context.Context = r.Context()
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+
+	ctx := withKeyNames(r.Context(), names...)
 	for key, val := range keys {
 		ctx = context.WithValue(ctx, contextKey(key), val)
 	}
 	return r.WithContext(ctx)
 }
 
+func withKeyNames(ctx context.Context, names ...string) context.Context {
+	prev, _ := ctx.Value(keyNamesKey{}).([]string)
+	all := make([]string, len(prev), len(prev)+len(names))
+	copy(all, prev)
+
+	return context.WithValue(ctx, keyNamesKey{}, append(all, names...))
+}
+
 // HandleRequestWithKeys does the same as HandleRequest but populates session.Keys with keys.
 func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
 	return m.HandleRequest(w, newRequestWithContextKeys(r, keys))
 }
 
 // Broadcast broadcasts a text message to all sessions.
+// Sessions are served from a list they join the end of on connect. When a
+// session disconnects the last one in the list takes its place, so the order
+// is only the connection order until the first disconnect. Every broadcast
+// starts one place further along the list than the one before, so a slow
+// session can't keep delaying the same clients.
 func (m *Melody) Broadcast(msg []byte) error {
-	if m.hub.closed() {
-		return ErrMelodyClosed
-	}
-
 	message := &envelope{t: websocket.TextMessage, msg: msg}
-	m.hub.broadcast <- message
 
-	return nil
+	return m.send(message)
+}
+
+// BroadcastCtx broadcasts a text message to all sessions like Broadcast,
+// passing ctx on to the HandleSentMessageInfo handler, ie: to carry a trace.
+// It doesn't cancel the broadcast.
+func (m *Melody) BroadcastCtx(ctx context.Context, msg []byte) error {
+	message := &envelope{t: websocket.TextMessage, msg: msg, ctx: ctx}
+
+	return m.send(message)
+}
+
+// BroadcastFilterCtx is BroadcastFilter with a context, see BroadcastCtx.
+func (m *Melody) BroadcastFilterCtx(ctx context.Context, msg []byte, fn func(*Session) bool) error {
+	message := &envelope{t: websocket.TextMessage, msg: msg, filter: fn, ctx: ctx}
+
+	return m.send(message)
 }
 
 // BroadcastFilter broadcasts a text message to all sessions that fn returns true for.
 func (m *Melody) BroadcastFilter(msg []byte, fn func(*Session) bool) error {
-	if m.hub.closed() {
-		return ErrMelodyClosed
-	}
-
 	message := &envelope{t: websocket.TextMessage, msg: msg, filter: fn}
-	m.hub.broadcast <- message
 
-	return nil
+	return m.send(message)
+}
+
+// BroadcastFunc broadcasts a text message built by fn for each session, so
+// every session can get its own payload. Sessions that fn returns false for
+// are skipped.
+func (m *Melody) BroadcastFunc(fn func(*Session) ([]byte, bool)) error {
+	message := &envelope{t: websocket.TextMessage, payload: fn}
+
+	return m.send(message)
 }
 
 // BroadcastOthers broadcasts a text message to all sessions except session s.
 func (m *Melody) BroadcastOthers(msg []byte, s *Session) error {
 	return m.BroadcastFilter(msg, func(q *Session) bool {
-		return s != q
+		return !q.Equal(s)
 	})
 }
 
+// BroadcastOthersFilter broadcasts a text message to all sessions except
+// session s that fn returns true for.
+func (m *Melody) BroadcastOthersFilter(msg []byte, s *Session, fn func(*Session) bool) error {
+	return m.BroadcastFilter(msg, othersFilter(s, fn))
+}
+
+// BroadcastExcept broadcasts a text message to all sessions except the sessions in exclude.
+func (m *Melody) BroadcastExcept(msg []byte, exclude ...*Session) error {
+	return m.BroadcastFilter(msg, excludeFilter(exclude))
+}
+
 // BroadcastMultiple broadcasts a text message to multiple sessions given in the sessions slice.
 func (m *Melody) BroadcastMultiple(msg []byte, sessions []*Session) error {
+	if m.hub.closed() {
+		return ErrMelodyClosed
+	}
+
 	for _, sess := range sessions {
 		if _, writeErr := sess.Write(msg); writeErr != nil {
 			return writeErr
@@ -266,65 +693,447 @@ func (m *Melody) BroadcastMultiple(msg []byte, sessions []*Session) error {
 	return nil
 }
 
-// BroadcastBinary broadcasts a binary message to all sessions.
-func (m *Melody) BroadcastBinary(msg []byte) error {
+// BroadcastToSubprotocol broadcasts a text message to all sessions that
+// negotiated subprotocol proto.
+func (m *Melody) BroadcastToSubprotocol(proto string, msg []byte) error {
+	return m.BroadcastFilter(msg, func(q *Session) bool {
+		return q.Subprotocol() == proto
+	})
+}
+
+// BroadcastToOlderThan broadcasts a text message to all sessions that have
+// been connected for longer than d.
+func (m *Melody) BroadcastToOlderThan(d time.Duration, msg []byte) error {
+	cutoff := m.config().clock().Now().Add(-d)
+
+	return m.BroadcastFilter(msg, func(q *Session) bool {
+		return q.connectedAt.Before(cutoff)
+	})
+}
+
+// BroadcastToNewerThan broadcasts a text message to all sessions that have
+// been connected for less than d.
+func (m *Melody) BroadcastToNewerThan(d time.Duration, msg []byte) error {
+	cutoff := m.config().clock().Now().Add(-d)
+
+	return m.BroadcastFilter(msg, func(q *Session) bool {
+		return q.connectedAt.After(cutoff)
+	})
+}
+
+// BroadcastReliable writes a text message with Session.WriteReliable to all
+// sessions that fn returns true for, a nil fn selects every session. The
+// returned BroadcastAck reports as the sessions acknowledge it. Sessions the
+// message couldn't be written to are left out.
+func (m *Melody) BroadcastReliable(msg []byte, fn func(*Session) bool) (*BroadcastAck, error) {
 	if m.hub.closed() {
-		return ErrMelodyClosed
+		return nil, ErrMelodyClosed
 	}
 
-	message := &envelope{t: websocket.BinaryMessage, msg: msg}
-	m.hub.broadcast <- message
+	sessions := m.hub.all()
+	b := newBroadcastAck(len(sessions))
 
-	return nil
+	// Hold the lock while writing so an acknowledgement can't arrive before
+	// its session is pending.
+	b.mutex.Lock()
+	for _, s := range sessions {
+		if fn != nil && !fn(s) {
+			continue
+		}
+
+		s := s
+		if _, err := s.writeReliable(msg, func() { b.ack(s) }); err == nil {
+			b.pending[s] = true
+		}
+	}
+
+	if len(b.pending) == 0 {
+		close(b.done)
+	}
+	b.mutex.Unlock()
+
+	return b, nil
 }
 
-// BroadcastBinaryFilter broadcasts a binary message to all sessions that fn returns true for.
-func (m *Melody) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
+// BroadcastToRoom broadcasts a text message to all sessions in room.
+func (m *Melody) BroadcastToRoom(room string, msg []byte) error {
+	message := &envelope{t: websocket.TextMessage, msg: msg, room: room}
+
+	return m.send(message)
+}
+
+// BroadcastToRoomExcept broadcasts a text message to all sessions in room
+// except the sessions in exclude, ie: the sender of a chat message.
+func (m *Melody) BroadcastToRoomExcept(room string, msg []byte, exclude ...*Session) error {
+	message := &envelope{t: websocket.TextMessage, msg: msg, room: room, filter: excludeFilter(exclude)}
+
+	return m.send(message)
+}
+
+// BroadcastToTag broadcasts a text message to all sessions tagged with tag.
+func (m *Melody) BroadcastToTag(tag string, msg []byte) error {
+	message := &envelope{t: websocket.TextMessage, msg: msg, tag: tag}
+
+	return m.send(message)
+}
+
+// CloseRoom closes every session in room with the given close code and reason
+// and removes the room.
+func (m *Melody) CloseRoom(room string, code int, reason string) error {
 	if m.hub.closed() {
 		return ErrMelodyClosed
 	}
 
-	message := &envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}
-	m.hub.broadcast <- message
+	sessions := m.hub.closeRoom(room)
+	for _, s := range sessions {
+		s.CloseWithMsg(FormatCloseMessage(code, reason))
+	}
+
+	if len(sessions) > 0 {
+		m.roomEmptyHandler(room)
+	}
 
 	return nil
 }
 
+// BroadcastBinary broadcasts a binary message to all sessions.
+func (m *Melody) BroadcastBinary(msg []byte) error {
+	message := &envelope{t: websocket.BinaryMessage, msg: msg}
+
+	return m.send(message)
+}
+
+// BroadcastBinaryCtx is BroadcastBinary with a context, see BroadcastCtx.
+func (m *Melody) BroadcastBinaryCtx(ctx context.Context, msg []byte) error {
+	message := &envelope{t: websocket.BinaryMessage, msg: msg, ctx: ctx}
+
+	return m.send(message)
+}
+
+// BroadcastBinaryToRoomExcept broadcasts a binary message to all sessions in
+// room except the sessions in exclude.
+func (m *Melody) BroadcastBinaryToRoomExcept(room string, msg []byte, exclude ...*Session) error {
+	message := &envelope{t: websocket.BinaryMessage, msg: msg, room: room, filter: excludeFilter(exclude)}
+
+	return m.send(message)
+}
+
+// BroadcastBinaryFilter broadcasts a binary message to all sessions that fn returns true for.
+func (m *Melody) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
+	message := &envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}
+
+	return m.send(message)
+}
+
 // BroadcastBinaryOthers broadcasts a binary message to all sessions except session s.
 func (m *Melody) BroadcastBinaryOthers(msg []byte, s *Session) error {
 	return m.BroadcastBinaryFilter(msg, func(q *Session) bool {
-		return s != q
+		return !q.Equal(s)
 	})
 }
 
-// Close closes the melody instance and all connected sessions.
-func (m *Melody) Close() error {
-	if m.hub.closed() {
-		return ErrMelodyAlreadyClosed
+// BroadcastBinaryOthersFilter broadcasts a binary message to all sessions
+// except session s that fn returns true for.
+func (m *Melody) BroadcastBinaryOthersFilter(msg []byte, s *Session, fn func(*Session) bool) error {
+	return m.BroadcastBinaryFilter(msg, othersFilter(s, fn))
+}
+
+// BroadcastBinaryExcept broadcasts a binary message to all sessions except the sessions in exclude.
+func (m *Melody) BroadcastBinaryExcept(msg []byte, exclude ...*Session) error {
+	return m.BroadcastBinaryFilter(msg, excludeFilter(exclude))
+}
+
+func excludeFilter(exclude []*Session) filterFunc {
+	excluded := make(map[*Session]bool, len(exclude))
+	for _, s := range exclude {
+		excluded[s] = true
 	}
 
-	m.hub.exit <- &envelope{t: websocket.CloseMessage, msg: []byte{}}
+	return func(q *Session) bool {
+		return !excluded[q]
+	}
+}
 
-	return nil
+func othersFilter(s *Session, fn filterFunc) filterFunc {
+	return func(q *Session) bool {
+		return !q.Equal(s) && fn(q)
+	}
+}
+
+// send hands message to the hub to be broadcast.
+func (m *Melody) send(message *envelope) error {
+	if m.tooBig(message.msg) {
+		return ErrOutboundMessageTooBig
+	}
+
+	message.concurrency = m.config().BroadcastConcurrency
+
+	return m.hub.send(message)
+}
+
+// tooBig reports whether msg is larger than Config.MaxOutboundMessageSize.
+func (m *Melody) tooBig(msg []byte) bool {
+	max := m.config().MaxOutboundMessageSize
+	return max > 0 && int64(len(msg)) > max
+}
+
+// BufferedBytes returns the number of bytes waiting to be written across all
+// sessions. Unlike Health it is a single atomic load.
+func (m *Melody) BufferedBytes() int64 {
+	return atomic.LoadInt64(&m.buffered)
+}
+
+// Close closes the melody instance and all connected sessions with a normal
+// closure close code.
+func (m *Melody) Close() error {
+	return m.closeHub(&envelope{t: websocket.CloseMessage, msg: FormatCloseMessage(CloseNormalClosure, "")})
 }
 
 // CloseWithMsg closes the melody instance with the given close payload and all connected sessions.
 // Use the FormatCloseMessage function to format a proper close message payload.
 func (m *Melody) CloseWithMsg(msg []byte) error {
+	return m.closeHub(&envelope{t: websocket.CloseMessage, msg: msg})
+}
+
+// closeHub closes the hub with msg and runs the OnShutdown callbacks once
+// every session connected at that point has been torn down.
+func (m *Melody) closeHub(msg *envelope) error {
+	if err := m.hub.close(msg); err != nil {
+		return err
+	}
+
+	go func() {
+		<-m.hub.done
+		for _, s := range m.hub.last {
+			<-s.finished
+		}
+		m.workers.stop()
+
+		m.shutdownMutex.Lock()
+		hooks := m.shutdownHooks
+		m.shutdownMutex.Unlock()
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i]()
+		}
+	}()
+
+	return nil
+}
+
+// OnShutdown registers fn to be called once the melody instance has been
+// closed and all its sessions have been torn down. Callbacks are called once,
+// in the reverse order they were registered.
+func (m *Melody) OnShutdown(fn func()) {
+	m.shutdownMutex.Lock()
+	defer m.shutdownMutex.Unlock()
+
+	m.shutdownHooks = append(m.shutdownHooks, fn)
+}
+
+// CloseWithTimeout closes the melody instance like Close and waits up to d for
+// every session to be torn down. Connections of sessions still open after d
+// are closed without a close handshake and ErrCloseTimeout is returned.
+func (m *Melody) CloseWithTimeout(d time.Duration) error {
+	sessions := m.hub.all()
+
+	if err := m.Close(); err != nil {
+		return err
+	}
+
+	expired, timer := newTimer(m.config().clock(), d)
+	defer timer.Stop()
+
+	for i, s := range sessions {
+		select {
+		case <-s.finished:
+		case <-expired:
+			for _, s := range sessions[i:] {
+				s.conn.Close()
+			}
+			return ErrCloseTimeout
+		}
+	}
+
+	return nil
+}
+
+// CloseAllWithMsg closes all connected sessions with the given close code and
+// reason but keeps the melody instance open. The close frame is sent even to
+// sessions with a full message buffer. With Config.CloseSpread set the
+// sessions are closed at even intervals over that window instead of at once,
+// CloseAllWithMsg then returns before they all are.
+func (m *Melody) CloseAllWithMsg(code int, reason string) error {
 	if m.hub.closed() {
-		return ErrMelodyAlreadyClosed
+		return ErrMelodyClosed
 	}
 
-	m.hub.exit <- &envelope{t: websocket.CloseMessage, msg: msg}
+	msg := FormatCloseMessage(code, reason)
+	sessions := m.hub.all()
+
+	var interval time.Duration
+	if len(sessions) > 1 {
+		interval = m.config().CloseSpread / time.Duration(len(sessions))
+	}
+
+	for i, s := range sessions {
+		s := s
+		closeSession := func() {
+			s.setReason(DisconnectServerClose)
+			s.closeNow(msg)
+		}
+
+		if i == 0 || interval <= 0 {
+			closeSession()
+		} else {
+			m.config().clock().AfterFunc(time.Duration(i)*interval, closeSession)
+		}
+	}
 
 	return nil
 }
 
+// ReplaceSession closes every other session whose identityKey holds value,
+// ie: to keep a single active session per user, and stores value under
+// identityKey for newSession. The close frame is sent with
+// Config.ReplacedCloseCode even to sessions with a full message buffer. It
+// visits every session, so it costs O(sessions), and value must be comparable.
+func (m *Melody) ReplaceSession(identityKey string, value interface{}, newSession *Session) error {
+	if m.hub.closed() {
+		return ErrMelodyClosed
+	}
+
+	newSession.Set(identityKey, value)
+
+	code := m.config().ReplacedCloseCode
+	if code == 0 {
+		code = ClosePolicyViolation
+	}
+	msg := FormatCloseMessage(code, "session replaced")
+
+	for _, s := range m.hub.all() {
+		if s == newSession {
+			continue
+		}
+
+		if v, ok := s.Get(identityKey); ok && v == value {
+			s.setReason(DisconnectReplaced)
+			s.closeNow(msg)
+		}
+	}
+
+	return nil
+}
+
+// CloseAllGoingAway closes all connected sessions with CloseGoingAway and
+// reason, ie: before a deploy, so clients reconnect straight away.
+func (m *Melody) CloseAllGoingAway(reason string) error {
+	return m.CloseAllWithMsg(CloseGoingAway, reason)
+}
+
+// Configure calls fn to change the configuration in place. Once HandleRequest
+// has been called sessions may be reading the configuration, fn is then not
+// called and ErrConfigInUse is returned.
+func (m *Melody) Configure(fn func(*Config)) error {
+	if atomic.LoadInt32(&m.served) != 0 {
+		return ErrConfigInUse
+	}
+
+	fn(m.Config)
+
+	// Uptime counts from now on a clock other than the one New read.
+	if _, system := m.Config.clock().(systemClock); !system {
+		m.startedAt = m.Config.clock().Now()
+	}
+
+	return nil
+}
+
+// UpdateConfig replaces the configuration of the melody instance and
+// propagates it to connected sessions. PingPeriod re-arms the ping ticker of
+// every session and PongWait applies from the next pong. MaxMessageSize
+// applies from the message after the one a session is currently waiting on,
+// which is still read with the old limit. MessageBufferSize only applies to
+// sessions that connect afterwards. An invalid config is rejected with the error from
+// Config.Validate and leaves the current one in place.
+func (m *Melody) UpdateConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	m.configMutex.Lock()
+	m.Config = &config
+	m.configMutex.Unlock()
+
+	m.hub.reconfigure()
+
+	return nil
+}
+
+// config returns the current configuration.
+func (m *Melody) config() *Config {
+	m.configMutex.RLock()
+	defer m.configMutex.RUnlock()
+
+	return m.Config
+}
+
 // Len return the number of connected sessions.
 func (m *Melody) Len() int {
 	return m.hub.len()
 }
 
+// ForEachSession calls fn for every connected session until fn returns
+// false. It walks a snapshot of the sessions taken when it is called, so fn
+// is free to call back into the melody instance.
+func (m *Melody) ForEachSession(fn func(*Session) bool) {
+	for _, s := range m.hub.all() {
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+// Rooms returns the names of all rooms with at least one session.
+func (m *Melody) Rooms() []string {
+	return m.hub.roomNames()
+}
+
+// RangeRooms calls fn for every room and its members until fn returns false.
+// It walks a snapshot of all rooms taken at once when it is called, so the
+// rooms are consistent with each other and fn is free to call back into the
+// melody instance.
+func (m *Melody) RangeRooms(fn func(room string, members []*Session) bool) {
+	for room, members := range m.hub.allRooms() {
+		if !fn(room, members) {
+			return
+		}
+	}
+}
+
+// RoomSessions returns a snapshot of the sessions in room.
+func (m *Melody) RoomSessions(room string) []*Session {
+	return m.hub.roomSessions(room)
+}
+
+// RoomLen returns the number of sessions in room.
+func (m *Melody) RoomLen(room string) int {
+	return m.hub.roomLen(room)
+}
+
+// LenByState returns the number of connected sessions that are open and the
+// number that are closing, ie: a close frame was queued or the connection
+// failed but the session has not been torn down yet.
+func (m *Melody) LenByState() (open, closing int) {
+	return m.hub.lenByState()
+}
+
+// Uptime returns how long ago the melody instance was created, measured on
+// Config.Clock. With a Clock set by Configure it counts from then instead.
+func (m *Melody) Uptime() time.Duration {
+	return m.config().clock().Now().Sub(m.startedAt)
+}
+
 // IsClosed returns the status of the melody instance.
 func (m *Melody) IsClosed() bool {
 	return m.hub.closed()
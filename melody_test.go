@@ -2,11 +2,19 @@ package melody
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
 	"time"
@@ -680,6 +688,4316 @@ func TestPong(t *testing.T) {
 	}
 }
 
+func TestWriteReliable(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.AckTimeout = 50 * time.Millisecond
+	echo.m.HandleConnect(func(session *Session) {
+		session.WriteReliable([]byte("first"))
+		session.WriteReliable([]byte("second"))
+	})
+
+	acked := make(chan uint64, 1)
+	echo.m.HandleAck(func(s *Session, id uint64) {
+		acked <- id
+	})
+
+	timedout := make(chan uint64, 1)
+	echo.m.HandleAckTimeout(func(s *Session, id uint64) {
+		timedout <- id
+	})
+
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "1:first" {
+		t.Errorf("%s should equal %s", string(ret), "1:first")
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("ack:1"))
+
+	select {
+	case id := <-acked:
+		if id != 1 {
+			t.Errorf("acked id %d should equal 1", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("should have fired ack handler")
+	}
+
+	select {
+	case id := <-timedout:
+		if id != 2 {
+			t.Errorf("timed out id %d should equal 2", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("should have fired ack timeout handler")
+	}
+}
+
+func TestMaxQueuedBytes(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MaxQueuedBytes = 8
+
+	errs := make(chan error, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		session.Write([]byte("12345"))
+		_, err := session.Write([]byte("12345"))
+		errs <- err
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := <-errs; err != ErrMessageBufferFull {
+		t.Errorf("%v should equal %v", err, ErrMessageBufferFull)
+	}
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "12345" {
+		t.Errorf("%s should equal %s", string(ret), "12345")
+	}
+}
+
+func TestUpgradeErrorHandler(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Upgrader.CheckOrigin = func(r *http.Request) bool { return false }
+	echo.m.Config.UpgradeErrorHandler = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		w.WriteHeader(http.StatusTeapot)
+	}
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{}
+	_, resp, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+
+	if err == nil {
+		t.Error("there should be a badhandshake error")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusTeapot {
+		t.Error("upgrade error handler should have written the response")
+	}
+}
+
+func TestBroadcastSendTimeout(t *testing.T) {
+	session := &Session{
+		output:  make(chan *envelope, 1),
+		melody:  New(),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+	}
+
+	msg := &envelope{t: websocket.TextMessage, msg: []byte("test")}
+	session.writeMessage(msg)
+
+	if err := session.writeMessageTimeout(msg, 10*time.Millisecond); err != ErrMessageBufferFull {
+		t.Errorf("%v should equal %v", err, ErrMessageBufferFull)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-session.output
+	}()
+
+	if err := session.writeMessageTimeout(msg, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	session := &Session{
+		output:  make(chan *envelope, 1),
+		melody:  New(),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+	}
+
+	session.melody.HandleError(func(s *Session, err error) {
+		t.Errorf("should not fire error handler: %v", err)
+	})
+
+	if !session.IsWritable() {
+		t.Error("session should be writable")
+	}
+
+	if !session.TryWrite([]byte("test")) {
+		t.Error("first write should succeed")
+	}
+
+	if session.IsWritable() {
+		t.Error("session should not be writable")
+	}
+
+	if session.TryWrite([]byte("test")) {
+		t.Error("second write should fail")
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan bool, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- true
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	pinged := make(chan bool, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- true:
+		default:
+		}
+		return nil
+	})
+	go conn.ReadMessage()
+
+	<-connected
+
+	config := *echo.m.Config
+	config.PingPeriod = 10 * time.Millisecond
+	echo.m.UpdateConfig(config)
+
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Error("session should have been pinged with the new period")
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.HandleMessage(func(session *Session, msg []byte) {
+		if string(msg) == "kick" {
+			session.Close()
+		}
+	})
+
+	reasons := make(chan DisconnectReason, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		reasons <- session.DisconnectReason()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseNormalClosure, ""))
+	conn.Close()
+
+	if reason := <-reasons; reason != DisconnectClientClose {
+		t.Errorf("%s should equal %s", reason, DisconnectClientClose)
+	}
+
+	conn, err = NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("kick"))
+	conn.ReadMessage()
+
+	if reason := <-reasons; reason != DisconnectKicked {
+		t.Errorf("%s should equal %s", reason, DisconnectKicked)
+	}
+}
+
+func TestWriteFlushed(t *testing.T) {
+	flushed := make(chan int, 1)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		n, err := session.WriteFlushed(msg)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		flushed <- n
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+
+	if n := <-flushed; n != 4 {
+		t.Errorf("flushed %d bytes, should be 4", n)
+	}
+}
+
+func TestRooms(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.HandleConnect(func(session *Session) {
+		session.Join("lobby")
+	})
+	echo.m.HandleMessage(func(session *Session, msg []byte) {
+		echo.m.BroadcastToRoom("lobby", msg)
+	})
+
+	empty := make(chan string, 1)
+	echo.m.HandleRoomEmpty(func(room string) {
+		empty <- room
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+
+	echo.m.CloseRoom("lobby", CloseNormalClosure, "game over")
+
+	_, _, err = conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, CloseNormalClosure) {
+		t.Errorf("%v should be a normal close error", err)
+	}
+
+	if room := <-empty; room != "lobby" {
+		t.Errorf("%s should equal %s", room, "lobby")
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	session := &Session{
+		output:  make(chan *envelope, 1),
+		melody:  New(),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+		done:    make(chan struct{}),
+	}
+
+	err := session.WriteDeadline([]byte("test"), time.Now().Add(10*time.Millisecond))
+
+	if err != ErrWriteTimeout {
+		t.Errorf("%v should equal %v", err, ErrWriteTimeout)
+	}
+}
+
+func TestBroadcastToSubprotocol(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.Upgrader.Subprotocols = []string{"v1", "v2"}
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		broadcast.m.BroadcastToSubprotocol("v2", []byte(session.Subprotocol()))
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"v2"}}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "v2" {
+		t.Errorf("%s should equal %s", string(ret), "v2")
+	}
+}
+
+func TestDrainOnClose(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		for i := 0; i < 3; i++ {
+			session.Write(msg)
+		}
+	})
+	echo.m.Config.DrainOnClose = true
+	echo.m.HandleSentMessage(func(session *Session, msg []byte) {
+		time.Sleep(10 * time.Millisecond)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+	conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseNormalClosure, ""))
+
+	for i := 0; i < 3; i++ {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(ret) != "test" {
+			t.Errorf("%s should equal %s", string(ret), "test")
+		}
+	}
+
+	_, _, err = conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, CloseNormalClosure) {
+		t.Errorf("%v should be a normal close error", err)
+	}
+}
+
+func TestCloseCode(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Close()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, _, err = conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, CloseNormalClosure) {
+		t.Errorf("%v should be a normal close error", err)
+	}
+}
+
+func TestWriteCompressed(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.WriteCompressed(msg, false)
+		session.WriteCompressed(msg, true)
+	})
+	echo.m.Upgrader.EnableCompression = true
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	msg := strings.Repeat("test", 64)
+	conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+	for i := 0; i < 2; i++ {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(ret) != msg {
+			t.Errorf("%s should equal %s", string(ret), msg)
+		}
+	}
+}
+
+func TestBroadcastClosed(t *testing.T) {
+	m := New()
+	m.Close()
+
+	all := func(*Session) bool { return true }
+	errs := []error{
+		m.Broadcast([]byte("test")),
+		m.BroadcastFilter([]byte("test"), all),
+		m.BroadcastOthers([]byte("test"), nil),
+		m.BroadcastMultiple([]byte("test"), nil),
+		m.BroadcastToSubprotocol("v1", []byte("test")),
+		m.BroadcastToRoom("lobby", []byte("test")),
+		m.BroadcastBinary([]byte("test")),
+		m.BroadcastBinaryFilter([]byte("test"), all),
+		m.BroadcastBinaryOthers([]byte("test"), nil),
+	}
+
+	for i, err := range errs {
+		if err != ErrMelodyClosed {
+			t.Errorf("broadcast %d: %v should equal %v", i, err, ErrMelodyClosed)
+		}
+	}
+
+	if err := m.Close(); err != ErrMelodyAlreadyClosed {
+		t.Errorf("%v should equal %v", err, ErrMelodyAlreadyClosed)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MessageBufferSize = 1
+
+	snapshots := make(chan HealthSnapshot, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		session.Write([]byte("test"))
+		snapshots <- echo.m.Health()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	health := <-snapshots
+
+	if health.Sessions != 1 {
+		t.Errorf("sessions %d should equal 1", health.Sessions)
+	}
+
+	if health.QueuedMessages != 1 || health.QueuedBytes != 4 {
+		t.Errorf("queued %d messages and %d bytes, should be 1 and 4", health.QueuedMessages, health.QueuedBytes)
+	}
+
+	if health.SlowSessions != 1 {
+		t.Errorf("slow sessions %d should equal 1", health.SlowSessions)
+	}
+}
+
+func TestBeforeUpgrade(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.HandleBeforeUpgrade(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return errors.New("unauthorized")
+		}
+		return nil
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{}
+	url := strings.Replace(server.URL, "http", "ws", 1)
+
+	_, resp, err := dialer.Dial(url, nil)
+
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("upgrade should have been rejected")
+	}
+
+	conn, _, err := dialer.Dial(url, http.Header{"Authorization": []string{"token"}})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	conn.Close()
+}
+
+func TestBroadcastExcept(t *testing.T) {
+	broadcast := NewTestServer()
+	lock := new(sync.Mutex)
+	var excluded []*Session
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if string(msg) == "exclude" {
+			excluded = append(excluded, session)
+			session.Write(msg)
+			return
+		}
+
+		broadcast.m.BroadcastExcept(msg, excluded...)
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	listeners := make([]*websocket.Conn, 2)
+	for i := range listeners {
+		listeners[i], _ = NewDialer(server.URL)
+		defer listeners[i].Close()
+
+		listeners[i].WriteMessage(websocket.TextMessage, []byte("exclude"))
+		listeners[i].ReadMessage()
+	}
+
+	conn, _ := NewDialer(server.URL)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+
+	for _, listener := range listeners {
+		listener.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := listener.ReadMessage(); err == nil {
+			t.Error("excluded session should not receive the message")
+		}
+	}
+}
+
+func TestInboundWorkers(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	echo.m.Config.InboundWorkers = 2
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	n := 20
+	for i := 0; i < n; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i)))
+	}
+
+	for i := 0; i < n; i++ {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(ret) != strconv.Itoa(i) {
+			t.Errorf("%s should equal %d", string(ret), i)
+		}
+	}
+}
+
+func TestLenByState(t *testing.T) {
+	echo := NewTestServer()
+	type counts struct{ open, closing int }
+	states := make(chan counts, 2)
+	echo.m.HandleConnect(func(session *Session) {
+		open, closing := echo.m.LenByState()
+		states <- counts{open, closing}
+		session.Close()
+		open, closing = echo.m.LenByState()
+		states <- counts{open, closing}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if c := <-states; c.open != 1 || c.closing != 0 {
+		t.Errorf("%d open and %d closing, should be 1 and 0", c.open, c.closing)
+	}
+
+	if c := <-states; c.open != 0 || c.closing != 1 {
+		t.Errorf("%d open and %d closing, should be 0 and 1", c.open, c.closing)
+	}
+}
+
+func TestReadErrorBackoff(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.ReadErrorBackoff = 20 * time.Millisecond
+
+	lock := new(sync.Mutex)
+	errs := 0
+	echo.m.HandleError(func(session *Session, err error) {
+		lock.Lock()
+		errs++
+		lock.Unlock()
+	})
+
+	disconnected := make(chan time.Time, 2)
+	echo.m.HandleDisconnect(func(session *Session) {
+		disconnected <- time.Now()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	start := time.Now()
+	conn.UnderlyingConn().Close()
+
+	if at := <-disconnected; at.Sub(start) < echo.m.Config.ReadErrorBackoff {
+		t.Error("teardown should have waited for the backoff")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if errs != 1 {
+		t.Errorf("read loop reported %d errors, should be 1", errs)
+	}
+
+	if len(disconnected) != 0 {
+		t.Error("session should disconnect once")
+	}
+}
+
+func TestCloseAllWithMsg(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MessageBufferSize = 1
+	connected := make(chan bool, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- true
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	<-connected
+	echo.m.CloseAllWithMsg(CloseServiceRestart, "restarting")
+
+	_, _, err = conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, CloseServiceRestart) {
+		t.Errorf("%v should be a service restart close error", err)
+	}
+
+	if echo.m.IsClosed() {
+		t.Error("melody should still be open")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	echo := NewTestServer()
+	n := 10
+	echo.m.HandleConnect(func(session *Session) {
+		for i := 0; i < n; i++ {
+			go session.Write([]byte("test"))
+			go session.writeControl(websocket.PingMessage, nil)
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < n; i++ {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(ret) != "test" {
+			t.Errorf("%s should equal %s", string(ret), "test")
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if err := session.PingWithPayload(msg); err != nil {
+			t.Error(err)
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	pinged := make(chan string, 1)
+	conn.SetPingHandler(func(payload string) error {
+		pinged <- payload
+		return nil
+	})
+	go conn.ReadMessage()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	select {
+	case payload := <-pinged:
+		if payload != "test" {
+			t.Errorf("%s should equal %s", payload, "test")
+		}
+	case <-time.After(time.Second):
+		t.Error("should have been pinged")
+	}
+}
+
+func TestSetMessageHandler(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write([]byte("main"))
+	})
+	echo.m.HandleConnect(func(session *Session) {
+		session.SetMessageHandler(func(s *Session, msg []byte) {
+			s.Write([]byte("handshake"))
+			s.SetMessageHandler(nil)
+		})
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, expected := range []string{"handshake", "main"} {
+		conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(ret) != expected {
+			t.Errorf("%s should equal %s", string(ret), expected)
+		}
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.WriteBinary(msg)
+	})
+	errs := make(chan error, 1)
+	echo.m.HandleError(func(session *Session, err error) {
+		errs <- err
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	invalid := []byte{0xff, 0xfe}
+	conn.WriteMessage(websocket.TextMessage, invalid)
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(ret, invalid) {
+		t.Errorf("%v should equal %v", ret, invalid)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseInvalidFramePayloadData, ""))
+
+	if err := <-errs; err != ErrInvalidUTF8 {
+		t.Errorf("%v should equal %v", err, ErrInvalidUTF8)
+	}
+}
+
+func TestBroadcastRotation(t *testing.T) {
+	m := New()
+	sessions := make([]*Session, 3)
+	for i := range sessions {
+		sessions[i] = &Session{
+			output:  make(chan *envelope, 2),
+			melody:  m,
+			open:    true,
+			rwmutex: &sync.RWMutex{},
+		}
+		m.hub.add(sessions[i])
+	}
+
+	for start := 0; start < 2; start++ {
+		served := make(chan *Session, len(sessions))
+		m.BroadcastFilter([]byte("test"), func(s *Session) bool {
+			served <- s
+			return true
+		})
+
+		for i := range sessions {
+			if s := <-served; s != sessions[(start+i)%len(sessions)] {
+				t.Errorf("broadcast %d served session %d out of turn", start, i)
+			}
+		}
+	}
+}
+
+func TestAge(t *testing.T) {
+	echo := NewTestServer()
+	ages := make(chan time.Duration, 1)
+	echo.m.HandleMessage(func(session *Session, msg []byte) {
+		ages <- session.Age()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	if age := <-ages; age < 10*time.Millisecond || age > echo.m.Uptime() {
+		t.Errorf("age %s should be between 10ms and uptime %s", age, echo.m.Uptime())
+	}
+}
+
+func TestRoomSessions(t *testing.T) {
+	m := New()
+	session := &Session{
+		melody:  m,
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+	}
+	m.hub.add(session)
+	session.Join("lobby")
+
+	if rooms := m.Rooms(); len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Errorf("rooms %v should equal [lobby]", rooms)
+	}
+
+	if sessions := m.RoomSessions("lobby"); len(sessions) != 1 || sessions[0] != session {
+		t.Error("lobby should contain the session")
+	}
+
+	session.Leave("lobby")
+
+	if m.RoomLen("lobby") != 0 || len(m.Rooms()) != 0 {
+		t.Error("lobby should be gone")
+	}
+}
+
+func TestOn(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.On("greet", func(session *Session, data json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return errors.New("name should be a string")
+		}
+
+		return session.WriteJSON("hello " + name)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"greet","data":"gopher"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"greet","data":42}`))
+
+	for _, expected := range []string{
+		`"hello gopher"`,
+		`{"type":"error","message":"name should be a string"}`,
+	} {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(ret) != expected {
+			t.Errorf("%s should equal %s", string(ret), expected)
+		}
+	}
+}
+
+func TestHandleMessageReader(t *testing.T) {
+	echo := NewTestServer()
+	chunks := make(chan string, 10)
+	echo.m.HandleMessageReader(func(session *Session, messageType int, r io.Reader) {
+		buf := make([]byte, 5)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				chunks <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{WriteBufferSize: 16}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A small write buffer makes the writer send a frame for every few bytes.
+	w, _ := conn.NextWriter(websocket.BinaryMessage)
+	w.Write([]byte(strings.Repeat("hello", 10)))
+
+	select {
+	case chunk := <-chunks:
+		if chunk != "hello" {
+			t.Errorf("%s should equal %s", chunk, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Error("should have read the start of the message before it ended")
+	}
+
+	w.Close()
+}
+
+func TestSetPingPeriod(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.HandleConnect(func(session *Session) {
+		session.SetPingPeriod(10 * time.Millisecond)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	pinged := make(chan bool, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- true:
+		default:
+		}
+		return nil
+	})
+	go conn.ReadMessage()
+
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Error("session should have been pinged with its own period")
+	}
+}
+
+func TestWaitClosed(t *testing.T) {
+	echo := NewTestServer()
+	sessions := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		sessions <- session
+	})
+
+	lock := new(sync.Mutex)
+	disconnected := false
+	echo.m.HandleDisconnect(func(session *Session) {
+		lock.Lock()
+		disconnected = true
+		lock.Unlock()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	session := <-sessions
+	session.Close()
+	session.WaitClosed()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !disconnected {
+		t.Error("disconnect handler should have run")
+	}
+}
+
+func TestMaxMessagesPerSecond(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MaxMessagesPerSecond = 5
+
+	rates := make(chan float64, 1)
+	echo.m.HandleRateExceeded(func(session *Session, rate float64) {
+		rates <- rate
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte("flood"))
+	}
+
+	if rate := <-rates; rate <= 5 {
+		t.Errorf("rate should be above 5, got %v", rate)
+	}
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, ClosePolicyViolation) {
+				t.Errorf("expected policy violation, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestBroadcastOthersFilter(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		if string(msg) == "join" {
+			session.Set("room", "a")
+			session.Write(msg)
+			return
+		}
+
+		broadcast.m.BroadcastOthersFilter(msg, session, func(q *Session) bool {
+			_, ok := q.Get("room")
+			return ok
+		})
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conns[i], _ = NewDialer(server.URL)
+		defer conns[i].Close()
+
+		if i < 2 {
+			conns[i].WriteMessage(websocket.TextMessage, []byte("join"))
+			conns[i].ReadMessage()
+		}
+	}
+
+	conns[0].WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conns[1].ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+
+	for _, i := range []int{0, 2} {
+		conns[i].SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := conns[i].ReadMessage(); err == nil {
+			t.Errorf("session %d should not receive the message", i)
+		}
+	}
+}
+
+func TestBufferedBytes(t *testing.T) {
+	echo := NewTestServer()
+	buffered := make(chan int64, 1)
+	sessions := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		for i := 0; i < 3; i++ {
+			session.Write([]byte("test"))
+		}
+		buffered <- echo.m.BufferedBytes()
+		sessions <- session
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if n := <-buffered; n != 12 {
+		t.Errorf("%d should equal %d", n, 12)
+	}
+
+	session := <-sessions
+	conn.Close()
+	session.WaitClosed()
+
+	if n := echo.m.BufferedBytes(); n != 0 {
+		t.Errorf("%d should equal %d", n, 0)
+	}
+}
+
+func TestCloseWait(t *testing.T) {
+	m := New()
+	defer m.Close()
+	session := &Session{melody: m}
+
+	if wait := session.writeWait(websocket.CloseMessage); wait != m.Config.WriteWait {
+		t.Errorf("%v should equal %v", wait, m.Config.WriteWait)
+	}
+
+	m.Config.CloseWait = time.Second
+
+	if wait := session.writeWait(websocket.CloseMessage); wait != time.Second {
+		t.Errorf("%v should equal %v", wait, time.Second)
+	}
+
+	if wait := session.writeWait(websocket.TextMessage); wait != m.Config.WriteWait {
+		t.Errorf("%v should equal %v", wait, m.Config.WriteWait)
+	}
+}
+
+func TestBroadcastByAge(t *testing.T) {
+	broadcast := NewTestServer()
+	connected := make(chan bool, 2)
+	broadcast.m.HandleConnect(func(session *Session) {
+		connected <- true
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	older, _ := NewDialer(server.URL)
+	defer older.Close()
+	<-connected
+
+	time.Sleep(50 * time.Millisecond)
+
+	newer, _ := NewDialer(server.URL)
+	defer newer.Close()
+	<-connected
+
+	broadcast.m.BroadcastToOlderThan(25*time.Millisecond, []byte("older"))
+	broadcast.m.BroadcastToNewerThan(25*time.Millisecond, []byte("newer"))
+
+	for conn, expected := range map[*websocket.Conn]string{older: "older", newer: "newer"} {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(ret) != expected {
+			t.Errorf("%s should equal %s", string(ret), expected)
+		}
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if err := session.WriteText(msg); err != nil {
+			t.Error(err)
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	typ, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if typ != websocket.TextMessage {
+		t.Errorf("%d should equal %d", typ, websocket.TextMessage)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	m := New()
+	defer m.Close()
+
+	if err := m.Config.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	config := *m.Config
+	config.PingPeriod = 0
+
+	if err := config.Validate(); err != ErrInvalidPingPeriod {
+		t.Errorf("%v should equal %v", err, ErrInvalidPingPeriod)
+	}
+
+	if err := m.UpdateConfig(config); err != ErrInvalidPingPeriod {
+		t.Errorf("%v should equal %v", err, ErrInvalidPingPeriod)
+	}
+
+	if m.Config.PingPeriod <= 0 {
+		t.Error("invalid config should not be applied")
+	}
+
+	m.Config.PingPeriod = -time.Second
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs <- m.HandleRequest(w, r)
+	}))
+	defer server.Close()
+
+	dialer := &websocket.Dialer{}
+	conn, resp, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err == nil {
+		conn.Close()
+		t.Error("dial should fail with an invalid config")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Error("invalid config should be answered with a server error")
+	}
+
+	if err := <-errs; err != ErrInvalidPingPeriod {
+		t.Errorf("%v should equal %v", err, ErrInvalidPingPeriod)
+	}
+}
+
+func TestUnknownMessageHandler(t *testing.T) {
+	m := New()
+	defer m.Close()
+
+	var typ int
+	var ret []byte
+	m.Config.UnknownMessageHandler = func(session *Session, t int, msg []byte) {
+		typ, ret = t, msg
+	}
+
+	session := &Session{melody: m, rwmutex: &sync.RWMutex{}}
+	session.dispatch(42, []byte("test"))
+
+	if typ != 42 {
+		t.Errorf("%d should equal %d", typ, 42)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+}
+
+func TestSetMulti(t *testing.T) {
+	session := &Session{Request: httptest.NewRequest("GET", "/", nil)}
+	session.SetMulti(map[string]interface{}{
+		"user": "alice",
+		"role": "admin",
+	})
+
+	if user := session.MustGet("user"); user != "alice" {
+		t.Errorf("%v should equal %v", user, "alice")
+	}
+
+	if role := session.MustGet("role"); role != "admin" {
+		t.Errorf("%v should equal %v", role, "admin")
+	}
+}
+
+func TestClosedByPeer(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Close()
+	})
+	closedByPeer := make(chan bool, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		closedByPeer <- session.ClosedByPeer()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, _ := NewDialer(server.URL)
+	conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseNormalClosure, ""))
+	conn.ReadMessage()
+	conn.Close()
+
+	if !<-closedByPeer {
+		t.Error("session should be closed by peer")
+	}
+
+	conn, _ = NewDialer(server.URL)
+	conn.WriteMessage(websocket.TextMessage, []byte("close"))
+	conn.ReadMessage()
+	conn.Close()
+
+	if <-closedByPeer {
+		t.Error("session should not be closed by peer")
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write([]byte(session.ID()))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, _ := NewDialer(server.URL)
+	conn.WriteMessage(websocket.TextMessage, []byte("id"))
+	_, first, _ := conn.ReadMessage()
+	conn.Close()
+
+	conn, _ = NewDialer(server.URL)
+	conn.WriteMessage(websocket.TextMessage, []byte("id"))
+	_, second, _ := conn.ReadMessage()
+	conn.Close()
+
+	if len(first) == 0 || string(first) == string(second) {
+		t.Errorf("ids should be unique, got %s and %s", first, second)
+	}
+
+	echo.m.Config.IDGenerator = func(r *http.Request) string {
+		return r.URL.Query().Get("user")
+	}
+
+	conn, _ = NewDialer(server.URL + "?user=alice")
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("id"))
+	_, ret, _ := conn.ReadMessage()
+
+	if string(ret) != "alice" {
+		t.Errorf("%s should equal %s", string(ret), "alice")
+	}
+}
+
+func TestBroadcastFunc(t *testing.T) {
+	broadcast := NewTestServer()
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		if string(msg) == "join" {
+			session.Set("name", "joined")
+			session.Write(msg)
+			return
+		}
+
+		broadcast.m.BroadcastFunc(func(q *Session) ([]byte, bool) {
+			name, ok := q.Get("name")
+			if !ok {
+				return nil, false
+			}
+
+			return []byte(name.(string) + ":" + string(msg)), true
+		})
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	joined, _ := NewDialer(server.URL)
+	defer joined.Close()
+	joined.WriteMessage(websocket.TextMessage, []byte("join"))
+	joined.ReadMessage()
+
+	other, _ := NewDialer(server.URL)
+	defer other.Close()
+	other.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := joined.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "joined:test" {
+		t.Errorf("%s should equal %s", string(ret), "joined:test")
+	}
+
+	other.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := other.ReadMessage(); err == nil {
+		t.Error("skipped session should not receive the message")
+	}
+}
+
+func TestHandleRequestWithContext(t *testing.T) {
+	m := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessions := make(chan *Session, 1)
+	m.HandleConnect(func(session *Session) {
+		sessions <- session
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleRequestWithContext(ctx, w, r, map[string]interface{}{"user": "alice"})
+	}))
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	session := <-sessions
+
+	if user := session.MustGet("user"); user != "alice" {
+		t.Errorf("%v should equal %v", user, "alice")
+	}
+
+	cancel()
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseNormalClosure) {
+		t.Errorf("expected normal closure, got %v", err)
+	}
+
+	session.WaitClosed()
+}
+
+func TestAddMessageHandler(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write([]byte("first"))
+	})
+	echo.m.AddMessageHandler(func(session *Session, msg []byte) {
+		session.Write([]byte("second"))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	for _, expected := range []string{"first", "second"} {
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(ret) != expected {
+			t.Errorf("%s should equal %s", string(ret), expected)
+		}
+	}
+}
+
+func TestBytesOnWire(t *testing.T) {
+	counts := make(chan [2]int64, 1)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		before := session.BytesWritten()
+		session.WriteFlushed(msg)
+		counts <- [2]int64{session.BytesRead(), session.BytesWritten() - before}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	// A masked client frame has a 2 byte header and a 4 byte mask, an
+	// unmasked server frame only the header.
+	c := <-counts
+
+	if c[0] != 10 {
+		t.Errorf("%d should equal %d", c[0], 10)
+	}
+
+	if c[1] != 6 {
+		t.Errorf("%d should equal %d", c[1], 6)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	for _, clean := range []bool{true, false} {
+		echo := NewTestServer()
+		connected := make(chan *Session, 1)
+		echo.m.HandleConnect(func(session *Session) {
+			connected <- session
+		})
+		server := httptest.NewServer(echo)
+
+		conn, err := NewDialer(server.URL)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		session := <-connected
+
+		if clean {
+			// Reading answers the close frame, a client that doesn't read
+			// never does.
+			go func() {
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+
+		err = echo.m.CloseWithTimeout(100 * time.Millisecond)
+
+		if clean && err != nil {
+			t.Error(err)
+		}
+
+		if !clean && err != ErrCloseTimeout {
+			t.Errorf("%v should equal %v", err, ErrCloseTimeout)
+		}
+
+		session.WaitClosed()
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestPingOnlyWhenIdle(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.PingPeriod = 50 * time.Millisecond
+	echo.m.Config.PingOnlyWhenIdle = true
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	pings := make(chan bool, 16)
+	conn.SetPingHandler(func(string) error {
+		pings <- true
+		return nil
+	})
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		conn.WriteMessage(websocket.TextMessage, []byte("busy"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(pings) != 0 {
+		t.Errorf("busy session should not be pinged, got %d pings", len(pings))
+	}
+
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Error("idle session should be pinged")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if string(msg) == "close" {
+			session.WriteErrorAndClose(4001, "bye")
+			return
+		}
+
+		session.WriteError(4000, "bad request")
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := `{"error":{"code":4000,"message":"bad request"}}`
+	if string(ret) != expected {
+		t.Errorf("%s should equal %s", string(ret), expected)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("close"))
+
+	_, ret, err = conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected = `{"error":{"code":4001,"message":"bye"}}`
+	if string(ret) != expected {
+		t.Errorf("%s should equal %s", string(ret), expected)
+	}
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseNormalClosure) {
+		t.Errorf("expected normal closure, got %v", err)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	m := New()
+	m.Config.PresenceKey = "user"
+	m.Config.PresenceDebounce = 100 * time.Millisecond
+
+	events := make(chan string, 4)
+	m.HandleOnline(func(identity string) {
+		events <- "online:" + identity
+	})
+	m.HandleOffline(func(identity string) {
+		events <- "offline:" + identity
+	})
+	disconnected := make(chan bool, 2)
+	m.HandleDisconnect(func(*Session) {
+		disconnected <- true
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleRequestWithKeys(w, r, map[string]interface{}{"user": "alice"})
+	}))
+	defer server.Close()
+
+	conn, _ := NewDialer(server.URL)
+
+	if event := <-events; event != "online:alice" {
+		t.Errorf("%s should equal %s", event, "online:alice")
+	}
+
+	// Reconnecting within the debounce is not seen as going offline.
+	conn.Close()
+	<-disconnected
+	conn, _ = NewDialer(server.URL)
+
+	conn.Close()
+	<-disconnected
+
+	if event := <-events; event != "offline:alice" {
+		t.Errorf("%s should equal %s", event, "offline:alice")
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %s", event)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestForEachSession(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan bool, 3)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- true
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, _ := NewDialer(server.URL)
+		defer conn.Close()
+		<-connected
+	}
+
+	visited := 0
+	echo.m.ForEachSession(func(*Session) bool {
+		visited++
+		return true
+	})
+
+	if visited != 3 {
+		t.Errorf("%d should equal %d", visited, 3)
+	}
+
+	visited = 0
+	echo.m.ForEachSession(func(*Session) bool {
+		visited++
+		return false
+	})
+
+	if visited != 1 {
+		t.Errorf("%d should equal %d", visited, 1)
+	}
+}
+
+func TestHandleSentMessageInfo(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.WriteBinary(msg)
+	})
+	sent := make(chan SentMessage, 1)
+	echo.m.HandleSentMessageInfo(func(session *Session, info SentMessage) {
+		sent <- info
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	info := <-sent
+
+	if info.Type != websocket.BinaryMessage {
+		t.Errorf("%d should equal %d", info.Type, websocket.BinaryMessage)
+	}
+
+	if string(info.Msg) != "test" {
+		t.Errorf("%s should equal %s", string(info.Msg), "test")
+	}
+
+	if info.WireBytes != 6 {
+		t.Errorf("%d should equal %d", info.WireBytes, 6)
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MaxConnectionLifetime = 50 * time.Millisecond
+	reasons := make(chan DisconnectReason, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		reasons <- session.DisconnectReason()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, CloseGoingAway) {
+		t.Errorf("expected going away, got %v", err)
+	}
+
+	if reason := <-reasons; reason != DisconnectLifetimeExceeded {
+		t.Errorf("%v should equal %v", reason, DisconnectLifetimeExceeded)
+	}
+}
+
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []chan time.Time
+	timers  []func()
+}
+
+type fakeTicker chan time.Time
+
+func (t fakeTicker) C() <-chan time.Time { return t }
+func (t fakeTicker) Stop()               {}
+
+type fakeTimer struct{}
+
+func (fakeTimer) Stop() bool { return true }
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := make(chan time.Time, 1)
+	c.tickers = append(c.tickers, t)
+	return fakeTicker(t)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.timers = append(c.timers, f)
+	return fakeTimer{}
+}
+
+// ready waits until the clock has n tickers and n timers.
+func (c *fakeClock) ready(n int) {
+	for {
+		c.mutex.Lock()
+		ok := len(c.tickers) >= n && len(c.timers) >= n
+		c.mutex.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *fakeClock) tick() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, t := range c.tickers {
+		select {
+		case t <- c.now:
+		default:
+		}
+	}
+}
+
+func (c *fakeClock) fire() {
+	c.mutex.Lock()
+	timers := c.timers
+	c.mutex.Unlock()
+	for _, f := range timers {
+		f()
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	echo := NewTestServer()
+	echo.m.Config.Clock = clock
+	echo.m.Config.MaxConnectionLifetime = time.Hour
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	pinged := make(chan bool, 1)
+	conn.SetPingHandler(func(string) error {
+		pinged <- true
+		return nil
+	})
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	clock.ready(1)
+	clock.tick()
+	<-pinged
+
+	clock.fire()
+
+	if err := <-closed; !websocket.IsCloseError(err, CloseGoingAway) {
+		t.Errorf("expected going away, got %v", err)
+	}
+}
+
+func TestBroadcastToTag(t *testing.T) {
+	broadcast := NewTestServer()
+	tags := make(chan []string, 1)
+	broadcast.m.HandleMessage(func(session *Session, msg []byte) {
+		session.AddTag("beta")
+		session.AddTag("region:eu")
+		session.RemoveTag("region:eu")
+		tags <- session.Tags()
+		session.Write(msg)
+	})
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	tagged, _ := NewDialer(server.URL)
+	defer tagged.Close()
+	tagged.WriteMessage(websocket.TextMessage, []byte("tag"))
+	tagged.ReadMessage()
+
+	if tags := <-tags; len(tags) != 1 || tags[0] != "beta" {
+		t.Errorf("%v should equal %v", tags, []string{"beta"})
+	}
+
+	other, _ := NewDialer(server.URL)
+	defer other.Close()
+
+	broadcast.m.BroadcastToTag("beta", []byte("test"))
+
+	_, ret, err := tagged.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(ret) != "test" {
+		t.Errorf("%s should equal %s", string(ret), "test")
+	}
+
+	other.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := other.ReadMessage(); err == nil {
+		t.Error("untagged session should not receive the message")
+	}
+}
+
+func TestMaxOutboundMessageSize(t *testing.T) {
+	errs := make(chan error, 2)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		_, err := session.Write(msg)
+		errs <- err
+		errs <- session.WriteBinary(msg)
+	})
+	echo.m.Config.MaxOutboundMessageSize = 4
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("too big"))
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrOutboundMessageTooBig {
+			t.Errorf("%v should equal %v", err, ErrOutboundMessageTooBig)
+		}
+	}
+
+	if err := echo.m.Broadcast([]byte("too big")); err != ErrOutboundMessageTooBig {
+		t.Errorf("%v should equal %v", err, ErrOutboundMessageTooBig)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("ok"))
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	states := make(chan SessionState, 1)
+	old := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Set("user", "alice")
+		session.Join("lobby")
+		session.AddTag("beta")
+		states <- session.Export()
+	})
+	oldServer := httptest.NewServer(old)
+	defer oldServer.Close()
+
+	conn, _ := NewDialer(oldServer.URL)
+	conn.WriteMessage(websocket.TextMessage, []byte("export"))
+	state := <-states
+	conn.Close()
+
+	imported := make(chan *Session, 1)
+	fresh := NewTestServer()
+	fresh.m.HandleConnect(func(session *Session) {
+		if err := fresh.m.ImportState(session, state); err != nil {
+			t.Error(err)
+		}
+		imported <- session
+	})
+	freshServer := httptest.NewServer(fresh)
+	defer freshServer.Close()
+
+	conn, _ = NewDialer(freshServer.URL)
+	defer conn.Close()
+	session := <-imported
+
+	if session.ID() != state.ID {
+		t.Errorf("%s should equal %s", session.ID(), state.ID)
+	}
+
+	if user := session.MustGet("user"); user != "alice" {
+		t.Errorf("%v should equal %v", user, "alice")
+	}
+
+	if tags := session.Tags(); len(tags) != 1 || tags[0] != "beta" {
+		t.Errorf("%v should equal %v", tags, []string{"beta"})
+	}
+
+	if n := fresh.m.RoomLen("lobby"); n != 1 {
+		t.Errorf("%d should equal %d", n, 1)
+	}
+}
+
+func TestBroadcastConcurrency(t *testing.T) {
+	m := New()
+	defer m.Close()
+	m.Config.BroadcastConcurrency = 4
+
+	sessions := newFanoutSessions(m, 10)
+	m.hub.fanout(&envelope{t: websocket.TextMessage, msg: []byte("test"), concurrency: 4}, sessions)
+
+	for i, s := range sessions {
+		if len(s.output) != 1 {
+			t.Errorf("session %d should have 1 message, has %d", i, len(s.output))
+		}
+	}
+}
+
+func TestWritePong(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.WritePong(msg)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	pongs := make(chan string, 1)
+	conn.SetPongHandler(func(payload string) error {
+		pongs <- payload
+		return nil
+	})
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("alive"))
+
+	if payload := <-pongs; payload != "alive" {
+		t.Errorf("%s should equal %s", payload, "alive")
+	}
+}
+
+func TestHandleCloseReply(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.HandleCloseReply(func(session *Session, code int, text string) (bool, int, string) {
+		return true, CloseTryAgainLater, "busy"
+	})
+	closedByPeer := make(chan bool, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		closedByPeer <- session.ClosedByPeer()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseNormalClosure, ""))
+
+	_, _, err = conn.ReadMessage()
+
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("expected close error, got %v", err)
+	}
+
+	if closeErr.Code != CloseTryAgainLater || closeErr.Text != "busy" {
+		t.Errorf("unexpected close frame %d %s", closeErr.Code, closeErr.Text)
+	}
+
+	if !<-closedByPeer {
+		t.Error("session should be closed by the peer")
+	}
+}
+
+func TestFairAdmission(t *testing.T) {
+	h := newHub()
+
+	for i, c := range []struct {
+		ip       string
+		admitted bool
+	}{
+		{"a", true},
+		{"a", true},
+		{"b", true},
+		{"a", true},
+		{"a", false},
+		{"b", true},
+	} {
+		if admitted := h.admit(c.ip, 6, true); admitted != c.admitted {
+			t.Errorf("admission %d of %s should be %v", i, c.ip, c.admitted)
+		}
+	}
+
+	h.release("a")
+
+	if !h.admit("a", 6, true) {
+		t.Error("released slot should be admitted")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MaxConnections = 1
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	dialer := &websocket.Dialer{}
+	_, resp, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+
+	if err == nil {
+		t.Error("second connection should be refused")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d response", http.StatusServiceUnavailable)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	errs := make(chan error, 2)
+	queued := make(chan int64, 1)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		for i := 0; i < 3; i++ {
+			session.Write(msg)
+		}
+		errs <- session.Flush(context.Background())
+		queued <- session.QueuedBytes()
+	})
+	echo.m.HandleConnect(func(session *Session) {
+		// The write pump isn't running yet, so nothing can be flushed.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		errs <- session.Flush(ctx)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Errorf("%v should equal %v", err, context.DeadlineExceeded)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+
+	if n := <-queued; n != 0 {
+		t.Errorf("%d should equal %d", n, 0)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	echo := NewTestServer()
+
+	err := echo.m.Configure(func(config *Config) {
+		config.MessageBufferSize = 16
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, _ := NewDialer(server.URL)
+	defer conn.Close()
+
+	err = echo.m.Configure(func(config *Config) {
+		config.MessageBufferSize = 32
+	})
+
+	if err != ErrConfigInUse {
+		t.Errorf("%v should equal %v", err, ErrConfigInUse)
+	}
+
+	if n := echo.m.Config.MessageBufferSize; n != 16 {
+		t.Errorf("%d should equal %d", n, 16)
+	}
+}
+
+func TestBroadcastReliable(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan bool, 2)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- true
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conns[i], _ = NewDialer(server.URL)
+		defer conns[i].Close()
+		<-connected
+	}
+
+	b, err := echo.m.BroadcastReliable([]byte("update"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := b.Pending(); n != 2 {
+		t.Errorf("%d should equal %d", n, 2)
+	}
+
+	for _, conn := range conns {
+		_, ret, _ := conn.ReadMessage()
+		id := strings.SplitN(string(ret), ":", 2)[0]
+		conn.WriteMessage(websocket.TextMessage, []byte("ack:"+id))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := b.Wait(ctx); err != nil {
+		t.Error(err)
+	}
+
+	if n := len(b.Acked()); n != 2 {
+		t.Errorf("%d should equal %d", n, 2)
+	}
+}
+
+func TestSessionTLS(t *testing.T) {
+	states := make(chan *tls.ConnectionState, 2)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		states <- session.TLS()
+	})
+
+	server := httptest.NewTLSServer(echo)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial(strings.Replace(server.URL, "https", "wss", 1), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	if state := <-states; state == nil || !state.HandshakeComplete {
+		t.Error("session should have a completed TLS state")
+	}
+
+	plain := httptest.NewServer(echo)
+	defer plain.Close()
+
+	conn, _ = NewDialer(plain.URL)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	if state := <-states; state != nil {
+		t.Error("plain session should have no TLS state")
+	}
+}
+
+func TestCompressionEnabled(t *testing.T) {
+	compressed := make(chan bool, 1)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		compressed <- session.CompressionEnabled()
+	})
+	echo.m.Upgrader.EnableCompression = true
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	for _, enable := range []bool{true, false} {
+		dialer := &websocket.Dialer{EnableCompression: enable}
+		conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+		if c := <-compressed; c != enable {
+			t.Errorf("%v should equal %v", c, enable)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestOnShutdown(t *testing.T) {
+	echo := NewTestServer()
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) {
+		mu.Lock()
+		calls = append(calls, name)
+		mu.Unlock()
+	}
+
+	shutdown := make(chan struct{})
+	echo.m.HandleDisconnect(func(*Session) {
+		record("disconnect")
+	})
+	echo.m.OnShutdown(func() {
+		record("first")
+		close(shutdown)
+	})
+	echo.m.OnShutdown(func() {
+		record("second")
+	})
+
+	connected := make(chan struct{})
+	echo.m.HandleConnect(func(*Session) {
+		close(connected)
+	})
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	<-connected
+
+	if err := echo.m.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if err := echo.m.Close(); err != ErrMelodyAlreadyClosed {
+		t.Errorf("%v should equal %v", err, ErrMelodyAlreadyClosed)
+	}
+
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown callbacks weren't called")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if got := strings.Join(calls, ","); got != "disconnect,second,first" {
+		t.Errorf("%s should equal disconnect,second,first", got)
+	}
+}
+
+func TestSetOutboundType(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		if string(msg) == "binary" {
+			if err := session.SetOutboundType(websocket.BinaryMessage); err != nil {
+				t.Error(err)
+			}
+		}
+
+		session.Write(msg)
+	})
+	echo.m.HandleConnect(func(session *Session) {
+		if err := session.SetOutboundType(websocket.PingMessage); err != ErrInvalidOutboundType {
+			t.Errorf("%v should equal %v", err, ErrInvalidOutboundType)
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	for _, want := range []struct {
+		msg string
+		typ int
+	}{
+		{"text", websocket.TextMessage},
+		{"binary", websocket.BinaryMessage},
+		{"again", websocket.BinaryMessage},
+	} {
+		conn.WriteMessage(websocket.TextMessage, []byte(want.msg))
+
+		typ, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if typ != want.typ {
+			t.Errorf("%d should equal %d", typ, want.typ)
+		}
+
+		if string(ret) != want.msg {
+			t.Errorf("%s should equal %s", ret, want.msg)
+		}
+	}
+}
+
+func TestReadBufferDisconnect(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var handled []string
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		started <- struct{}{}
+		<-release
+		handled = append(handled, string(msg))
+	})
+	echo.m.Config.ReadBufferMessages = 1
+	echo.m.Config.ReadBufferPolicy = ReadBufferDisconnect
+	disconnected := make(chan struct{})
+	echo.m.HandleDisconnect(func(session *Session) {
+		close(disconnected)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("1"))
+	<-started
+	conn.WriteMessage(websocket.TextMessage, []byte("2"))
+	conn.WriteMessage(websocket.TextMessage, []byte("3"))
+
+	_, _, err = conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, CloseTryAgainLater) {
+		t.Errorf("%v should be a %d close error", err, CloseTryAgainLater)
+	}
+
+	close(release)
+	<-disconnected
+
+	if got := strings.Join(handled, ","); got != "1,2" {
+		t.Errorf("%s should equal 1,2", got)
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		conn, ok := session.NetConn().(*net.TCPConn)
+
+		if !ok {
+			t.Errorf("%T should be a *net.TCPConn", session.NetConn())
+		} else if err := conn.SetNoDelay(true); err != nil {
+			t.Error(err)
+		}
+
+		session.Write(msg)
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "test" {
+		t.Errorf("%s should equal test (%v)", ret, err)
+	}
+}
+
+func TestSlowClientHandlers(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.SlowClientThreshold = 4
+	entered := make(chan *Session, 1)
+	left := make(chan *Session, 1)
+	echo.m.Config.SlowClientEnterHandler = func(s *Session) {
+		entered <- s
+	}
+	echo.m.Config.SlowClientLeaveHandler = func(s *Session) {
+		left <- s
+	}
+	connected := make(chan *Session, 1)
+	echo.m.HandleConnect(func(s *Session) {
+		connected <- s
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	session := <-connected
+
+	// The client doesn't read until the session is slow, so the socket
+	// buffers fill up and messages start queueing.
+	msg := bytes.Repeat([]byte("x"), 1<<20)
+	const count = 32
+	for i := 0; i < count; i++ {
+		if err := session.WriteBinary(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case s := <-entered:
+		if s != session {
+			t.Error("enter handler should fire for the slow session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("enter handler wasn't called")
+	}
+
+	if n := echo.m.Health().SlowSessions; n != 1 {
+		t.Errorf("slow sessions %d should equal 1", n)
+	}
+
+	for i := 0; i < count; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-left:
+	case <-time.After(time.Second):
+		t.Fatal("leave handler wasn't called")
+	}
+
+	if n := echo.m.Health().SlowSessions; n != 0 {
+		t.Errorf("slow sessions %d should equal 0", n)
+	}
+
+	if n := session.QueueLen(); n != 0 {
+		t.Errorf("%d should equal 0", n)
+	}
+}
+
+type testPoint struct {
+	X int
+}
+
+// testCodec frames a testPoint as "point:<x>".
+type testCodec struct{}
+
+func (testCodec) Encode(v interface{}) ([]byte, error) {
+	p, ok := v.(*testPoint)
+	if !ok {
+		return nil, errors.New("not a point")
+	}
+
+	return []byte("point:" + strconv.Itoa(p.X)), nil
+}
+
+func (testCodec) Type(msg []byte) (string, error) {
+	i := bytes.IndexByte(msg, ':')
+	if i < 0 {
+		return "", errors.New("no type")
+	}
+
+	return string(msg[:i]), nil
+}
+
+func (testCodec) Decode(msg []byte, v interface{}) error {
+	x, err := strconv.Atoi(string(msg[bytes.IndexByte(msg, ':')+1:]))
+	if err != nil {
+		return err
+	}
+
+	v.(*testPoint).X = x
+	return nil
+}
+
+func TestOnBinary(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.BinaryCodec = testCodec{}
+	echo.m.OnBinary("point", func() interface{} { return &testPoint{} }, func(s *Session, v interface{}) {
+		p := v.(*testPoint)
+		p.X++
+		if err := s.WriteEncoded(p); err != nil {
+			t.Error(err)
+		}
+	})
+	echo.m.HandleMessageBinary(func(s *Session, msg []byte) {
+		s.WriteBinary(append([]byte("raw:"), msg...))
+	})
+	errs := make(chan error, 1)
+	echo.m.HandleError(func(s *Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	for _, c := range []struct{ in, out string }{
+		{"point:41", "point:42"},
+		{"other", "raw:other"},
+	} {
+		conn.WriteMessage(websocket.BinaryMessage, []byte(c.in))
+
+		_, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(ret) != c.out {
+			t.Errorf("%s should equal %s", ret, c.out)
+		}
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte("point:x"))
+
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Error("decoding error should be passed to the error handler")
+	}
+
+	m := New()
+	defer m.Close()
+
+	if err := (&Session{melody: m}).WriteEncoded(&testPoint{}); err != ErrNoBinaryCodec {
+		t.Errorf("%v should equal %v", err, ErrNoBinaryCodec)
+	}
+}
+
+func TestSlowSessions(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan *Session, 1)
+	echo.m.HandleConnect(func(s *Session) {
+		connected <- s
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	session := <-connected
+
+	if slow := echo.m.SlowSessions(0); len(slow) != 0 {
+		t.Errorf("%d should equal 0", len(slow))
+	}
+
+	// Nothing is read, so the socket buffers fill up and messages queue.
+	msg := bytes.Repeat([]byte("x"), 1<<20)
+	const count = 32
+	for i := 0; i < count; i++ {
+		session.WriteBinary(msg)
+	}
+
+	if slow := echo.m.SlowSessions(4); len(slow) != 1 || slow[0] != session {
+		t.Errorf("%v should only contain the session", slow)
+	}
+
+	if slow := echo.m.SlowSessions(count); len(slow) != 0 {
+		t.Errorf("%d should equal 0", len(slow))
+	}
+}
+
+func TestEchoPingPayload(t *testing.T) {
+	for _, echoPayload := range []bool{true, false} {
+		echo := NewTestServer()
+		echo.m.Config.EchoPingPayload = echoPayload
+		server := httptest.NewServer(echo)
+
+		conn, err := NewDialer(server.URL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pongs := make(chan string, 1)
+		conn.SetPongHandler(func(appData string) error {
+			pongs <- appData
+			return nil
+		})
+		go conn.ReadMessage()
+
+		conn.WriteControl(websocket.PingMessage, []byte("seq-1"), time.Now().Add(time.Second))
+
+		want := ""
+		if echoPayload {
+			want = "seq-1"
+		}
+
+		select {
+		case got := <-pongs:
+			if got != want {
+				t.Errorf("%q should equal %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Error("ping wasn't answered")
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestReader(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		t.Error("message handler should not fire with an active reader")
+	})
+	closed := make(chan struct{})
+	echo.m.HandleConnect(func(session *Session) {
+		reader := session.Reader()
+		go func() {
+			for m := range reader {
+				session.WriteBinary(append([]byte(strconv.Itoa(m.Type)+":"), m.Data...))
+			}
+			close(closed)
+		}()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if want := strconv.Itoa(websocket.TextMessage) + ":test"; string(ret) != want {
+		t.Errorf("%s should equal %s", ret, want)
+	}
+
+	conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("reader should be closed with the session")
+	}
+}
+
+func TestCloseAllGoingAway(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MessageBufferSize = 1
+	connected := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- session
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	session := <-connected
+
+	// Fill the buffer, the close frame must still get through.
+	session.Write([]byte("test"))
+	session.Write([]byte("test"))
+
+	if err := echo.m.CloseAllGoingAway("deploying"); err != nil {
+		t.Error(err)
+	}
+
+	for {
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+
+	closeErr, ok := err.(*websocket.CloseError)
+
+	if !ok || closeErr.Code != CloseGoingAway || closeErr.Text != "deploying" {
+		t.Errorf("%v should be a going away close error", err)
+	}
+}
+
+func TestUse(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	echo.m.Use(func(s *Session, msg []byte) ([]byte, bool, error) {
+		if string(msg) == "auth" {
+			s.Set("authed", true)
+			return nil, false, nil
+		}
+
+		if string(msg) == "fail" {
+			return nil, false, errors.New("fail")
+		}
+
+		return bytes.ToUpper(msg), true, nil
+	})
+	echo.m.Use(func(s *Session, msg []byte) ([]byte, bool, error) {
+		if _, ok := s.Get("authed"); !ok {
+			return nil, false, nil
+		}
+
+		return append(msg, '!'), true, nil
+	})
+	errs := make(chan error, 1)
+	echo.m.HandleError(func(s *Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// Dropped by the second middleware before authenticating.
+	conn.WriteMessage(websocket.TextMessage, []byte("early"))
+	conn.WriteMessage(websocket.TextMessage, []byte("auth"))
+	conn.WriteMessage(websocket.TextMessage, []byte("fail"))
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, ret, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(ret) != "TEST!" {
+		t.Errorf("%s should equal TEST!", ret)
+	}
+
+	select {
+	case err := <-errs:
+		if err.Error() != "fail" {
+			t.Errorf("%v should equal fail", err)
+		}
+	default:
+		t.Error("middleware error should be passed to the error handler")
+	}
+}
+
+// fakeConn records what is written to it, standing in for a session.
+type fakeConn struct {
+	Conn
+	written []string
+}
+
+func (c *fakeConn) WriteText(msg []byte) error {
+	c.written = append(c.written, string(msg))
+	return nil
+}
+
+func greet(c Conn, name string) error {
+	return c.WriteText([]byte("hello " + name))
+}
+
+func TestConn(t *testing.T) {
+	fake := &fakeConn{}
+	greet(fake, "fake")
+
+	if len(fake.written) != 1 || fake.written[0] != "hello fake" {
+		t.Errorf("%v should equal [hello fake]", fake.written)
+	}
+
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		greet(session, string(msg))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("session"))
+
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "hello session" {
+		t.Errorf("%s should equal hello session (%v)", ret, err)
+	}
+}
+
+func TestCloseSpread(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	echo := NewTestServer()
+	echo.m.Config.Clock = clock
+	echo.m.Config.CloseSpread = time.Minute
+	connected := make(chan bool, 3)
+	echo.m.HandleConnect(func(*Session) {
+		connected <- true
+	})
+	disconnected := make(chan bool, 3)
+	echo.m.HandleDisconnect(func(*Session) {
+		disconnected <- true
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := NewDialer(server.URL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		<-connected
+	}
+
+	if err := echo.m.CloseAllWithMsg(CloseGoingAway, ""); err != nil {
+		t.Error(err)
+	}
+
+	<-disconnected
+
+	clock.mutex.Lock()
+	scheduled := len(clock.timers)
+	clock.mutex.Unlock()
+
+	if scheduled != 2 {
+		t.Errorf("%d should equal 2", scheduled)
+	}
+
+	if n := echo.m.Len(); n != 2 {
+		t.Errorf("%d should equal 2", n)
+	}
+
+	clock.fire()
+	<-disconnected
+	<-disconnected
+}
+
+func TestBroadcastCtx(t *testing.T) {
+	type traceKey struct{}
+
+	echo := NewTestServer()
+	connected := make(chan bool, 1)
+	echo.m.HandleConnect(func(*Session) {
+		connected <- true
+	})
+	traces := make(chan interface{}, 2)
+	echo.m.HandleSentMessageInfo(func(s *Session, sent SentMessage) {
+		traces <- sent.Context.Value(traceKey{})
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	<-connected
+
+	echo.m.BroadcastCtx(context.WithValue(context.Background(), traceKey{}, "abc"), []byte("test"))
+	echo.m.Broadcast([]byte("test"))
+
+	for _, want := range []interface{}{"abc", nil} {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := <-traces; got != want {
+			t.Errorf("%v should equal %v", got, want)
+		}
+	}
+}
+
+func TestMaxTotalBufferedBytes(t *testing.T) {
+	m := New()
+	defer m.Close()
+	m.Config.MaxTotalBufferedBytes = 10
+
+	a, b := &Session{melody: m}, &Session{melody: m}
+
+	if err := a.reserve(8); err != nil {
+		t.Error(err)
+	}
+
+	if err := b.reserve(8); err != ErrTotalBufferFull {
+		t.Errorf("%v should equal %v", err, ErrTotalBufferFull)
+	}
+
+	if n := m.BufferedBytes(); n != 8 {
+		t.Errorf("%d should equal 8", n)
+	}
+
+	a.unreserve(8)
+
+	// A message larger than the limit still gets through when nothing else is buffered.
+	if err := b.reserve(16); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleRequestRoom(t *testing.T) {
+	m := New()
+	defer m.Close()
+	joined := make(chan bool, 2)
+	m.HandleConnect(func(s *Session) {
+		rooms := m.hub.sessionRooms(s)
+		joined <- len(rooms) == 1 && rooms[0] == strings.TrimPrefix(s.Request.URL.Path, "/room/")
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleRequestRoom(w, r, func(r *http.Request) string {
+			return strings.TrimPrefix(r.URL.Path, "/room/")
+		})
+	}))
+	defer server.Close()
+
+	a, err := NewDialer(server.URL + "/room/a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer a.Close()
+
+	b, err := NewDialer(server.URL + "/room/b")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer b.Close()
+
+	for i := 0; i < 2; i++ {
+		if !<-joined {
+			t.Error("session should join its room before connect fires")
+		}
+	}
+
+	m.BroadcastToRoom("b", []byte("b"))
+	m.BroadcastToRoom("a", []byte("a"))
+
+	for conn, want := range map[*websocket.Conn]string{a: "a", b: "b"} {
+		if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != want {
+			t.Errorf("%s should equal %s (%v)", ret, want, err)
+		}
+	}
+}
+
+func TestWriteFailureClosesReadSide(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- session
+	})
+	reasons := make(chan DisconnectReason, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		reasons <- session.DisconnectReason()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	session := <-connected
+
+	// Only the write direction fails, the connection can still be read.
+	session.NetConn().(*net.TCPConn).CloseWrite()
+	session.Write([]byte("test"))
+
+	select {
+	case reason := <-reasons:
+		if reason != DisconnectWriteError {
+			t.Errorf("%v should equal %v", reason, DisconnectWriteError)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session should be torn down without waiting for PongWait")
+	}
+}
+
+func TestConfigEcho(t *testing.T) {
+	for _, after := range []bool{false, true} {
+		handled := make(chan string, 3)
+		echo := NewTestServerHandler(func(session *Session, msg []byte) {
+			handled <- string(msg)
+		})
+		echo.m.Config.Echo = true
+		echo.m.Config.EchoAfterHandlers = after
+		echo.m.Config.EchoMaxSize = 4
+		server := httptest.NewServer(echo)
+
+		conn, err := NewDialer(server.URL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte("large"))
+		conn.WriteMessage(websocket.BinaryMessage, []byte("test"))
+
+		typ, ret, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if typ != websocket.BinaryMessage || string(ret) != "test" {
+			t.Errorf("%d %s should equal %d test", typ, ret, websocket.BinaryMessage)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte("text"))
+
+		if typ, _, _ := conn.ReadMessage(); typ != websocket.TextMessage {
+			t.Errorf("%d should equal %d", typ, websocket.TextMessage)
+		}
+
+		if after {
+			if msg := <-handled; msg != "large" {
+				t.Errorf("%s should equal large", msg)
+			}
+		} else if len(handled) != 0 {
+			t.Error("handlers should be skipped")
+		}
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	extensions := make(chan []string, 1)
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		extensions <- session.Extensions()
+	})
+	echo.m.Upgrader.EnableCompression = true
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	for _, enable := range []bool{true, false} {
+		dialer := &websocket.Dialer{EnableCompression: enable}
+		conn, resp, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+		got := strings.Join(<-extensions, ", ")
+		if want := resp.Header.Get("Sec-WebSocket-Extensions"); got != want {
+			t.Errorf("%q should equal %q", got, want)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestBroadcastToRoomExcept(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan bool, 3)
+	echo.m.HandleConnect(func(session *Session) {
+		if session.Request.URL.Query().Get("room") == "lobby" {
+			session.Join("lobby")
+		}
+		connected <- true
+	})
+	echo.m.HandleMessage(func(session *Session, msg []byte) {
+		echo.m.BroadcastToRoomExcept("lobby", msg, session)
+		echo.m.BroadcastBinaryToRoomExcept("lobby", msg, session)
+		echo.m.BroadcastToRoom("lobby", []byte("end"))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	var conns []*websocket.Conn
+	for _, query := range []string{"?room=lobby", "?room=lobby", ""} {
+		conn, err := NewDialer(server.URL + query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	for range conns {
+		<-connected
+	}
+
+	conns[0].WriteMessage(websocket.TextMessage, []byte("test"))
+
+	for i, want := range []struct {
+		typ int
+		msg string
+	}{
+		{websocket.TextMessage, "test"},
+		{websocket.BinaryMessage, "test"},
+		{websocket.TextMessage, "end"},
+	} {
+		typ, ret, err := conns[1].ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if typ != want.typ || string(ret) != want.msg {
+			t.Errorf("message %d: %d %s should equal %d %s", i, typ, ret, want.typ, want.msg)
+		}
+	}
+
+	if _, ret, err := conns[0].ReadMessage(); err != nil || string(ret) != "end" {
+		t.Errorf("%s should equal end, the sender is excluded (%v)", ret, err)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		<-release
+	})
+	echo.m.Config.HandlerTimeout = 50 * time.Millisecond
+	echo.m.Config.HandlerTimeoutPolicy = HandlerTimeoutClose
+	errs := make(chan error, 1)
+	echo.m.HandleError(func(s *Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	reasons := make(chan DisconnectReason, 1)
+	echo.m.HandleDisconnect(func(s *Session) {
+		reasons <- s.DisconnectReason()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	_, _, err = conn.ReadMessage()
+
+	if !websocket.IsCloseError(err, CloseInternalServerErr) {
+		t.Errorf("%v should be an internal server error close error", err)
+	}
+
+	if err := <-errs; err != ErrHandlerTimeout {
+		t.Errorf("%v should equal %v", err, ErrHandlerTimeout)
+	}
+
+	close(release)
+
+	if reason := <-reasons; reason != DisconnectHandlerTimeout {
+		t.Errorf("%v should equal %v", reason, DisconnectHandlerTimeout)
+	}
+}
+
+func TestWriteWithMeta(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.WriteWithMeta(msg, "id-1")
+		session.Write(msg)
+	})
+	metas := make(chan interface{}, 2)
+	echo.m.HandleSentMessageInfo(func(s *Session, sent SentMessage) {
+		metas <- sent.Meta
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	for _, want := range []interface{}{"id-1", nil} {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := <-metas; got != want {
+			t.Errorf("%v should equal %v", got, want)
+		}
+	}
+}
+
+func TestRangeRooms(t *testing.T) {
+	echo := NewTestServer()
+	connected := make(chan *Session, 2)
+	echo.m.HandleConnect(func(session *Session) {
+		session.Join("all")
+		session.Join(session.Request.URL.Query().Get("room"))
+		connected <- session
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	for _, room := range []string{"a", "b"} {
+		conn, err := NewDialer(server.URL + "?room=" + room)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		<-connected
+	}
+
+	sizes := map[string]int{}
+	echo.m.RangeRooms(func(room string, members []*Session) bool {
+		sizes[room] = len(members)
+		return true
+	})
+
+	if len(sizes) != 3 || sizes["all"] != 2 || sizes["a"] != 1 || sizes["b"] != 1 {
+		t.Errorf("%v should have all:2 a:1 b:1", sizes)
+	}
+
+	visited := 0
+	echo.m.RangeRooms(func(string, []*Session) bool {
+		visited++
+		return false
+	})
+
+	if visited != 1 {
+		t.Errorf("%d should equal 1", visited)
+	}
+}
+
+func TestHandlePingSummary(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	echo := NewTestServer()
+	echo.m.Config.Clock = clock
+	summaries := make(chan PingSummary, 2)
+	echo.m.HandlePingSummary(func(summary PingSummary) {
+		summaries <- summary
+	})
+	ponged := make(chan bool, 1)
+	echo.m.HandlePong(func(*Session) {
+		ponged <- true
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The summary ticker and the ping ticker of the session.
+	for {
+		clock.mutex.Lock()
+		n := len(clock.tickers)
+		clock.mutex.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.tick()
+	first := <-summaries
+	<-ponged
+	clock.tick()
+	second := <-summaries
+
+	if pings := first.Pings + second.Pings; pings < 1 {
+		t.Errorf("%d pings should be at least 1", pings)
+	}
+
+	if pongs := first.Pongs + second.Pongs; pongs < 1 {
+		t.Errorf("%d pongs should be at least 1", pongs)
+	}
+
+	if first.Interval != time.Minute {
+		t.Errorf("%v should equal %v", first.Interval, time.Minute)
+	}
+}
+
+func TestJoinWithPriority(t *testing.T) {
+	a, b, c := &Session{}, &Session{}, &Session{}
+	ranked := rankedMembers(map[*Session]int{a: 1, b: 5, c: 3})
+
+	if len(ranked) != 3 || ranked[0] != b || ranked[1] != c || ranked[2] != a {
+		t.Error("members should be ordered by descending priority")
+	}
+
+	echo := NewTestServer()
+	connected := make(chan *Session, 2)
+	echo.m.HandleConnect(func(session *Session) {
+		if session.Request.URL.Query().Get("host") != "" {
+			session.JoinWithPriority("lobby", 10)
+		} else {
+			session.Join("lobby")
+		}
+		connected <- session
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	var conns []*websocket.Conn
+	var sessions []*Session
+	for _, query := range []string{"?host=1", ""} {
+		conn, err := NewDialer(server.URL + query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+		conns = append(conns, conn)
+		sessions = append(sessions, <-connected)
+	}
+
+	echo.m.BroadcastToRoom("lobby", []byte("state"))
+
+	for _, conn := range conns {
+		if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "state" {
+			t.Errorf("%s should equal state (%v)", ret, err)
+		}
+	}
+
+	sessions[0].Leave("lobby")
+
+	echo.m.hub.rwmutex.RLock()
+	n := len(echo.m.hub.ranks)
+	echo.m.hub.rwmutex.RUnlock()
+
+	if n != 0 {
+		t.Errorf("%d should equal 0", n)
+	}
+}
+
+func TestHandleMessageForProtocol(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(append([]byte("default:"), msg...))
+	})
+	echo.m.Upgrader.Subprotocols = []string{"v1", "v2"}
+	echo.m.HandleMessageForProtocol("v2", func(session *Session, msg []byte) {
+		session.Write(append([]byte("v2:"), msg...))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	for proto, want := range map[string]string{"v1": "default:test", "v2": "v2:test"} {
+		dialer := &websocket.Dialer{Subprotocols: []string{proto}}
+		conn, _, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+		if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != want {
+			t.Errorf("%s should equal %s (%v)", ret, want, err)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestReplaceSession(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.ReplacedCloseCode = 4001
+	connected := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- session
+	})
+	reasons := make(chan DisconnectReason, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		reasons <- session.DisconnectReason()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	first, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer first.Close()
+
+	if err := echo.m.ReplaceSession("user", "alice", <-connected); err != nil {
+		t.Error(err)
+	}
+
+	second, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer second.Close()
+
+	session := <-connected
+	echo.m.ReplaceSession("user", "alice", session)
+
+	_, _, err = first.ReadMessage()
+
+	if !websocket.IsCloseError(err, 4001) {
+		t.Errorf("%v should be a 4001 close error", err)
+	}
+
+	if reason := <-reasons; reason != DisconnectReplaced {
+		t.Errorf("%v should equal %v", reason, DisconnectReplaced)
+	}
+
+	if user, _ := session.Get("user"); user != "alice" || session.IsClosed() {
+		t.Error("the new session should stay open with the identity set")
+	}
+}
+
+func TestSetWriteWait(t *testing.T) {
+	m := New()
+	defer m.Close()
+	session := &Session{melody: m}
+
+	session.SetWriteWait(time.Second)
+	session.SetInitialWriteWait(time.Millisecond, 2)
+
+	// Control frames don't use up the initial writes.
+	if wait := session.writeWait(websocket.PingMessage); wait != time.Second {
+		t.Errorf("%v should equal %v", wait, time.Second)
+	}
+
+	for _, want := range []time.Duration{time.Millisecond, time.Millisecond, time.Second} {
+		if wait := session.writeWait(websocket.TextMessage); wait != want {
+			t.Errorf("%v should equal %v", wait, want)
+		}
+	}
+
+	session.SetWriteWait(0)
+
+	if wait := session.writeWait(websocket.BinaryMessage); wait != m.Config.WriteWait {
+		t.Errorf("%v should equal %v", wait, m.Config.WriteWait)
+	}
+}
+
+func TestMaxMessageSizeZero(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	echo.m.Config.MaxMessageSize = 0
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	msg := bytes.Repeat([]byte("x"), 4096)
+	conn.WriteMessage(websocket.TextMessage, msg)
+
+	if _, ret, err := conn.ReadMessage(); err != nil || !bytes.Equal(ret, msg) {
+		t.Errorf("a zero max message size should not limit reads (%v)", err)
+	}
+
+	config := *echo.m.Config
+	config.MaxMessageSize = -1
+
+	if err := config.Validate(); err != ErrInvalidMaxMessageSize {
+		t.Errorf("%v should equal %v", err, ErrInvalidMaxMessageSize)
+	}
+}
+
+func TestBroadcastSendTimeoutErrorHandlerCloses(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MessageBufferSize = 1
+	echo.m.Config.BroadcastSendTimeout = 20 * time.Millisecond
+
+	closing := make(chan bool, 1)
+	closing <- true
+	full := make(chan bool)
+	connected := make(chan bool, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		connected <- true
+	})
+	echo.m.HandleError(func(session *Session, err error) {
+		if err != ErrMessageBufferFull {
+			return
+		}
+
+		select {
+		case <-closing:
+			session.Close()
+			close(full)
+		default:
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	<-connected
+
+	// The client never reads, so the buffer fills once the socket does.
+	msg := bytes.Repeat([]byte("x"), 1<<20)
+	deadline := time.After(5 * time.Second)
+loop:
+	for {
+		select {
+		case <-full:
+			break loop
+		case <-deadline:
+			t.Fatal("buffer should have filled")
+		default:
+			echo.m.Broadcast(msg)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		echo.m.Broadcast([]byte("test"))
+		echo.m.Broadcast([]byte("test"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("hub should not be stuck behind the error handler")
+	}
+
+	if skipped := echo.m.Health().SkippedBroadcasts; skipped < 1 {
+		t.Errorf("skipped broadcasts %d should be at least 1", skipped)
+	}
+}
+
+func TestFlushStoppedWritePump(t *testing.T) {
+	session := &Session{
+		output:  make(chan *envelope, 1),
+		melody:  New(),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+		stopped: make(chan struct{}),
+	}
+
+	session.output <- &envelope{t: websocket.TextMessage, msg: []byte("test")}
+	close(session.stopped)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Flush(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		if err != ErrSessionClosed {
+			t.Errorf("%v should equal %v", err, ErrSessionClosed)
+		}
+	case <-time.After(time.Second):
+		t.Error("flush should not wait on a stopped write pump")
+	}
+}
+
+func TestReaderAbandoned(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.ReadBufferMessages = 0
+
+	sessions := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		session.Reader()
+		sessions <- session
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-sessions
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	if err := session.Close(); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case <-session.Done():
+	case <-time.After(time.Second):
+		t.Error("session should close with nobody reading its reader")
+	}
+}
+
+func TestCloseBufferFull(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MessageBufferSize = 1
+
+	errs := make(chan error, 1)
+	reasons := make(chan DisconnectReason, 1)
+	opened := make(chan int, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		// The write pump isn't running yet, so the buffer stays full.
+		session.Write([]byte("test"))
+		errs <- session.Close()
+		reasons <- session.DisconnectReason()
+		open, _ := echo.m.LenByState()
+		opened <- open
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	defer conn.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := <-errs; err != ErrMessageBufferFull {
+		t.Errorf("%v should equal %v", err, ErrMessageBufferFull)
+	}
+
+	if reason := <-reasons; reason != DisconnectUnknown {
+		t.Errorf("%v should equal %v", reason, DisconnectUnknown)
+	}
+
+	if open := <-opened; open != 1 {
+		t.Errorf("%d open should equal 1", open)
+	}
+}
+
+func TestIdleTickerRearm(t *testing.T) {
+	idle := newIdleTicker(systemClock{}, 20*time.Millisecond)
+	defer idle.Stop()
+
+	timer := idle.timer
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		idle.rearm(20 * time.Millisecond)
+	}
+
+	if idle.timer != timer {
+		t.Error("rearm should reuse the system clock timer")
+	}
+
+	select {
+	case <-idle.C():
+	case <-time.After(time.Second):
+		t.Error("idle ticker should tick once rearming stops")
+	}
+}
+
+func TestUpdateConfigPartial(t *testing.T) {
+	echo := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write([]byte(session.ID() + " " + session.Age().String()))
+		session.WriteError(4000, "bad request")
+		session.WriteReliable(msg)
+	})
+	acked := make(chan uint64, 1)
+	echo.m.HandleAck(func(session *Session, id uint64) {
+		acked <- id
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	// Fields left out of the literal fall back to their defaults.
+	err := echo.m.UpdateConfig(Config{
+		WriteWait:         time.Second,
+		PongWait:          time.Second,
+		PingPeriod:        time.Second / 2,
+		MaxMessageSize:    512,
+		MessageBufferSize: 16,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("ack:1"))
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Error("ack should be parsed with the default format")
+	}
+}
+
+func TestWriteDeadlineMidWrite(t *testing.T) {
+	msg := bytes.Repeat([]byte("x"), 8<<20)
+	echo := NewTestServerHandler(func(session *Session, _ []byte) {
+		session.WriteBinaryDeadline(msg, time.Now().Add(5*time.Millisecond))
+		session.Write([]byte("after"))
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("test"))
+
+	// The deadline passes while the message is being written, which must
+	// not end the session.
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ret, err := conn.ReadMessage(); err != nil || len(ret) != len(msg) {
+		t.Fatalf("should read the whole message (%v)", err)
+	}
+
+	if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "after" {
+		t.Errorf("%s should equal after (%v)", ret, err)
+	}
+}
+
+func TestSlowClientHandlerOnClose(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.SlowClientThreshold = 1
+	entered := make(chan int, 1)
+	echo.m.Config.SlowClientEnterHandler = func(s *Session) {
+		entered <- echo.m.Len()
+	}
+	errs := make(chan error, 1)
+	echo.m.HandleConnect(func(s *Session) {
+		// The write pump isn't running yet, so the close message queued by
+		// Close makes the session slow.
+		s.Write([]byte("test"))
+		go echo.m.Close()
+
+		select {
+		case <-entered:
+			errs <- nil
+		case <-time.After(time.Second):
+			errs <- errors.New("enter handler should be able to call back into melody")
+		}
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisconnectBufferFull(t *testing.T) {
+	echo := NewTestServer()
+	echo.m.Config.MessageBufferSize = 1
+	echo.m.HandleError(func(session *Session, err error) {
+		if err == ErrMessageBufferFull {
+			session.Close()
+		}
+	})
+	echo.m.HandleConnect(func(session *Session) {
+		// The write pump isn't running yet, so the second write overflows.
+		session.Write([]byte("first"))
+		session.Write([]byte("second"))
+	})
+	reasons := make(chan DisconnectReason, 1)
+	echo.m.HandleDisconnect(func(session *Session) {
+		reasons <- session.DisconnectReason()
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != DisconnectBufferFull {
+			t.Errorf("%v should equal %v", reason, DisconnectBufferFull)
+		}
+	case <-time.After(time.Second):
+		t.Error("session should have been closed")
+	}
+}
+
+func TestWorkerPoolLifecycle(t *testing.T) {
+	m := New()
+	m.workers.start(2)
+	m.workers.start(4)
+	m.workers.start(1)
+
+	if m.workers.size != 4 {
+		t.Errorf("%d workers should equal 4", m.workers.size)
+	}
+
+	stopped := make(chan bool, 1)
+	m.OnShutdown(func() {
+		_, ok := <-m.workers.tasks
+		stopped <- !ok
+	})
+	m.Close()
+
+	select {
+	case ok := <-stopped:
+		if !ok {
+			t.Error("workers should be stopped on shutdown")
+		}
+	case <-time.After(time.Second):
+		t.Error("shutdown hooks should have run")
+	}
+}
+
+func TestAckTimeoutAfterDisconnect(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	echo := NewTestServer()
+	echo.m.Config.Clock = clock
+	connected := make(chan *Session, 1)
+	echo.m.HandleConnect(func(session *Session) {
+		session.WriteReliable([]byte("test"))
+		connected <- session
+	})
+	timeouts := make(chan uint64, 1)
+	echo.m.HandleAckTimeout(func(session *Session, id uint64) {
+		timeouts <- id
+	})
+	server := httptest.NewServer(echo)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-connected
+	conn.Close()
+	session.WaitClosed()
+
+	if n := session.Unacked(); n != 0 {
+		t.Errorf("%d should equal 0", n)
+	}
+
+	// The fake clock fires every timer it armed, stopped or not.
+	clock.fire()
+
+	select {
+	case id := <-timeouts:
+		t.Errorf("ack timeout for %d should not fire after disconnect", id)
+	default:
+	}
+}
+
+func TestClockTimeouts(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	m := New()
+	defer m.Close()
+	m.Configure(func(c *Config) {
+		c.Clock = clock
+	})
+
+	clock.mutex.Lock()
+	clock.now = clock.now.Add(time.Hour)
+	clock.mutex.Unlock()
+
+	if uptime := m.Uptime(); uptime != time.Hour {
+		t.Errorf("%s should equal %s", uptime, time.Hour)
+	}
+
+	session := &Session{
+		output:  make(chan *envelope, 1),
+		melody:  m,
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+	}
+
+	msg := &envelope{t: websocket.TextMessage, msg: []byte("test")}
+	session.writeMessage(msg)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- session.writeMessageTimeout(msg, time.Hour)
+	}()
+
+	// Nothing drains the buffer, the wait ends once the fake clock fires.
+	for {
+		clock.mutex.Lock()
+		armed := len(clock.timers) > 0
+		clock.mutex.Unlock()
+		if armed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.fire()
+
+	select {
+	case err := <-errs:
+		if err != ErrMessageBufferFull {
+			t.Errorf("%v should equal %v", err, ErrMessageBufferFull)
+		}
+	case <-time.After(time.Second):
+		t.Error("send timeout should follow the fake clock")
+	}
+}
+
 func BenchmarkSessionWrite(b *testing.B) {
 	echo := NewTestServerHandler(func(session *Session, msg []byte) {
 		session.Write(msg)
@@ -723,3 +5041,62 @@ func BenchmarkBroadcast(b *testing.B) {
 		conns[i].Close()
 	}
 }
+
+func BenchmarkWriteMessage(b *testing.B) {
+	session := &Session{
+		output:  make(chan *envelope, 1),
+		melody:  New(),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+	}
+
+	msg := []byte("test")
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		session.Write(msg)
+		(<-session.output).release()
+	}
+}
+
+func newFanoutSessions(m *Melody, n int) []*Session {
+	sessions := make([]*Session, n)
+	for i := range sessions {
+		sessions[i] = &Session{
+			output:  make(chan *envelope, 1),
+			melody:  m,
+			open:    true,
+			rwmutex: &sync.RWMutex{},
+		}
+		m.hub.add(sessions[i])
+	}
+
+	return sessions
+}
+
+func benchmarkFanout(b *testing.B, concurrency int) {
+	m := New()
+	defer m.Close()
+
+	sessions := newFanoutSessions(m, 100000)
+	message := &envelope{t: websocket.TextMessage, msg: []byte("test"), concurrency: concurrency}
+
+	for n := 0; n < b.N; n++ {
+		m.hub.fanout(message, m.hub.recipients(message))
+
+		b.StopTimer()
+		for _, s := range sessions {
+			<-s.output
+			s.unreserve(int64(len(message.msg)))
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkFanoutSerial(b *testing.B) {
+	benchmarkFanout(b, 1)
+}
+
+func BenchmarkFanoutParallel(b *testing.B) {
+	benchmarkFanout(b, runtime.GOMAXPROCS(0))
+}
@@ -0,0 +1,35 @@
+package melody
+
+// Middleware inspects a text or binary message read from a session before it
+// is handled. It returns the message to pass on, which it may rewrite, and
+// whether to keep processing it. Returning false or an error consumes the
+// message: later middleware and the message handlers don't see it, and the
+// error is passed to the HandleError handler.
+type Middleware func(s *Session, msg []byte) ([]byte, bool, error)
+
+// Use appends mw to the chain of middleware run on every text and binary
+// message, in the order they were added, before On, OnBinary and the message
+// handlers. Messages consumed through Reader skip the chain.
+func (m *Melody) Use(mw Middleware) {
+	m.middleware = append(m.middleware, mw)
+}
+
+// runMiddleware passes message through the middleware chain and reports
+// whether it should still be handled.
+func (s *Session) runMiddleware(message []byte) ([]byte, bool) {
+	for _, mw := range s.melody.middleware {
+		next, ok, err := mw(s, message)
+		if err != nil {
+			s.melody.errorHandler(s, err)
+			return nil, false
+		}
+
+		if !ok {
+			return nil, false
+		}
+
+		message = next
+	}
+
+	return message, true
+}
@@ -0,0 +1,88 @@
+package melody
+
+import (
+	"sync"
+	"time"
+)
+
+// presence counts the sessions of every identity, see Config.PresenceKey.
+type presence struct {
+	mutex    sync.Mutex
+	sessions map[string]int
+	offline  map[string]*offlineTimer
+}
+
+// offlineTimer delays the offline event of an identity by
+// Config.PresenceDebounce.
+type offlineTimer struct {
+	timer Timer
+}
+
+func newPresence() *presence {
+	return &presence{
+		sessions: make(map[string]int),
+		offline:  make(map[string]*offlineTimer),
+	}
+}
+
+// connect counts a session of id and reports whether id came online. A
+// session that reconnects while id is waiting to go offline cancels that.
+func (p *presence) connect(id string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	online := false
+	if t, ok := p.offline[id]; ok {
+		t.timer.Stop()
+		delete(p.offline, id)
+	} else if p.sessions[id] == 0 {
+		online = true
+	}
+
+	p.sessions[id]++
+
+	return online
+}
+
+// disconnect uncounts a session of id and reports whether id went offline
+// right away. With a positive debounce fn fires once debounce passes without
+// a session of id connecting instead.
+func (p *presence) disconnect(id string, clock Clock, debounce time.Duration, fn func(string)) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.sessions[id]--
+	if p.sessions[id] > 0 {
+		return false
+	}
+
+	delete(p.sessions, id)
+
+	if debounce <= 0 {
+		return true
+	}
+
+	t := &offlineTimer{}
+	p.offline[id] = t
+	t.timer = clock.AfterFunc(debounce, func() {
+		if p.expire(id, t) {
+			fn(id)
+		}
+	})
+
+	return false
+}
+
+// expire reports whether t is still the pending offline timer of id.
+func (p *presence) expire(id string, t *offlineTimer) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.offline[id] != t {
+		return false
+	}
+
+	delete(p.offline, id)
+
+	return true
+}
@@ -0,0 +1,41 @@
+package melody
+
+import "time"
+
+// rateWindow remembers when the last max messages were read from a session,
+// so it can tell when more than max arrive within a second.
+type rateWindow struct {
+	times []time.Time
+	next  int
+}
+
+func newRateWindow(max int) *rateWindow {
+	if max <= 0 {
+		return nil
+	}
+
+	return &rateWindow{times: make([]time.Time, max)}
+}
+
+// hit records a message read at now. If it is more than max within the last
+// second it returns the observed rate in messages per second and true.
+func (w *rateWindow) hit(now time.Time) (float64, bool) {
+	oldest := w.times[w.next]
+	w.times[w.next] = now
+	w.next = (w.next + 1) % len(w.times)
+
+	if oldest.IsZero() {
+		return 0, false
+	}
+
+	elapsed := now.Sub(oldest)
+	if elapsed >= time.Second {
+		return 0, false
+	}
+
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+
+	return float64(len(w.times)+1) / elapsed.Seconds(), true
+}
@@ -0,0 +1,68 @@
+package melody
+
+// Message is a message read from a session, see Session.Reader.
+type Message struct {
+	Type int
+	Data []byte
+}
+
+// Reader returns a channel that yields the text and binary messages read from
+// session instead of passing them to the message handlers. It is closed once
+// the session stops reading. The channel buffers up to
+// Config.ReadBufferMessages messages, and Config.ReadBufferPolicy decides
+// what happens when the buffer is full. Using a Reader on a session that
+// also has message handlers is not supported.
+func (s *Session) Reader() <-chan Message {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	if s.reader == nil {
+		s.reader = make(chan Message, s.melody.config().ReadBufferMessages)
+		if s.readerDone {
+			close(s.reader)
+		}
+	}
+
+	return s.reader
+}
+
+func (s *Session) activeReader() chan Message {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.reader
+}
+
+// pushReader sends a message to the Reader channel of session.
+func (s *Session) pushReader(reader chan Message, t int, msg []byte) error {
+	m := Message{Type: t, Data: msg}
+
+	if s.melody.config().ReadBufferPolicy == ReadBufferDisconnect {
+		select {
+		case reader <- m:
+			return nil
+		default:
+			return s.readBufferFull()
+		}
+	}
+
+	// Close gets writePump to return once the close message is written, so an
+	// abandoned Reader can't keep the session open.
+	select {
+	case reader <- m:
+		return nil
+	case <-s.stopped:
+		return ErrSessionClosed
+	}
+}
+
+// closeReader closes the Reader channel of session once reading has stopped.
+func (s *Session) closeReader() {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	s.readerDone = true
+	if s.reader != nil {
+		close(s.reader)
+	}
+}
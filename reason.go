@@ -0,0 +1,73 @@
+package melody
+
+import (
+	"net"
+
+	"github.com/gorilla/websocket"
+)
+
+// DisconnectReason describes why a session ended.
+type DisconnectReason int
+
+// Reasons a session can end for.
+const (
+	DisconnectUnknown          DisconnectReason = iota // The session is still open.
+	DisconnectServerClose                              // The melody instance was closed.
+	DisconnectClientClose                              // The client sent a close frame.
+	DisconnectReadError                                // Reading from the connection failed.
+	DisconnectWriteError                               // Writing to the connection failed.
+	DisconnectIdleTimeout                              // The client stopped answering pings.
+	DisconnectKicked                                   // The session was closed by the application.
+	DisconnectBufferFull                               // The session was closed from the error handler for ErrMessageBufferFull, or its read buffer overflowed.
+	DisconnectRateExceeded                             // The session sent more than Config.MaxMessagesPerSecond.
+	DisconnectLifetimeExceeded                         // The session was connected for longer than Config.MaxConnectionLifetime.
+	DisconnectHandlerTimeout                           // Handling a message took longer than Config.HandlerTimeout.
+	DisconnectReplaced                                 // A newer session of the same identity replaced it, see Melody.ReplaceSession.
+)
+
+var disconnectReasonNames = map[DisconnectReason]string{
+	DisconnectUnknown:          "unknown",
+	DisconnectServerClose:      "server-close",
+	DisconnectClientClose:      "client-close",
+	DisconnectReadError:        "read-error",
+	DisconnectWriteError:       "write-error",
+	DisconnectIdleTimeout:      "idle",
+	DisconnectKicked:           "kicked",
+	DisconnectBufferFull:       "buffer-full",
+	DisconnectRateExceeded:     "rate-exceeded",
+	DisconnectLifetimeExceeded: "lifetime-exceeded",
+	DisconnectHandlerTimeout:   "handler-timeout",
+	DisconnectReplaced:         "replaced",
+}
+
+func (r DisconnectReason) String() string {
+	if name, ok := disconnectReasonNames[r]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// closer is the side of a connection that sent the first close frame.
+type closer int8
+
+const (
+	closedByNone closer = iota
+	closedBySelf
+	closedByPeer
+)
+
+// readErrorReason classifies an error returned from reading a connection.
+func readErrorReason(err error) DisconnectReason {
+	// Gorilla reports a dropped connection as an abnormal closure, no close
+	// frame was actually received then.
+	if e, ok := err.(*websocket.CloseError); ok && e.Code != CloseAbnormalClosure {
+		return DisconnectClientClose
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return DisconnectIdleTimeout
+	}
+
+	return DisconnectReadError
+}
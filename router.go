@@ -0,0 +1,75 @@
+package melody
+
+import "encoding/json"
+
+type handleEventFunc func(*Session, json.RawMessage) error
+
+// event is the shape of text messages routed by On, ie:
+// {"type": "join", "data": {"room": "lobby"}}.
+type event struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// errorReply is the default reply sent when an event handler fails.
+type errorReply struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func defaultErrorReplyFormatter(err error) interface{} {
+	return errorReply{Type: "error", Message: err.Error()}
+}
+
+// errorEnvelope is the default shape of errors written by Session.WriteError,
+// ie: {"error": {"code": 4000, "message": "bad request"}}.
+type errorEnvelope struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func defaultErrorFormat(code int, message string) []byte {
+	var e errorEnvelope
+	e.Error.Code = code
+	e.Error.Message = message
+
+	msg, _ := json.Marshal(e)
+	return msg
+}
+
+// On fires fn when a text message of the form {"type": name, "data": ...}
+// comes in, instead of the HandleMessage handler. If fn returns an error the
+// reply built by Config.ErrorReplyFormatter is written back to the session.
+func (m *Melody) On(name string, fn func(*Session, json.RawMessage) error) {
+	if m.events == nil {
+		m.events = make(map[string]handleEventFunc)
+	}
+
+	m.events[name] = fn
+}
+
+// route fires the event handler registered for message and reports whether
+// there was one.
+func (s *Session) route(message []byte) bool {
+	if len(s.melody.events) == 0 {
+		return false
+	}
+
+	var e event
+	if err := json.Unmarshal(message, &e); err != nil {
+		return false
+	}
+
+	fn, ok := s.melody.events[e.Type]
+	if !ok {
+		return false
+	}
+
+	if err := fn(s, e.Data); err != nil {
+		s.WriteJSON(s.melody.config().errorReplyFormatter()(err))
+	}
+
+	return true
+}
@@ -1,62 +1,270 @@
 package melody
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
-	ErrWriteToClosedSession = errors.New("tried to write to a closed session")
-	ErrMessageBufferFull    = errors.New("session message buffer is full")
-	ErrSessionClosed        = errors.New("session is closed")
-	ErrSessionAlreadyClosed = errors.New("session is already closed")
+	ErrWriteToClosedSession  = errors.New("tried to write to a closed session")
+	ErrMessageBufferFull     = errors.New("session message buffer is full")
+	ErrSessionClosed         = errors.New("session is closed")
+	ErrSessionAlreadyClosed  = errors.New("session is already closed")
+	ErrWriteTimeout          = errors.New("message was not written before its deadline")
+	ErrInboundQueueFull      = errors.New("session inbound queue is full")
+	ErrInvalidUTF8           = errors.New("session closed the connection over invalid utf-8 data")
+	ErrRateExceeded          = errors.New("session exceeded the maximum message rate")
+	ErrOutboundMessageTooBig = errors.New("message is larger than the maximum outbound message size")
+	ErrInvalidOutboundType   = errors.New("outbound message type must be text or binary")
+	ErrReadBufferFull        = errors.New("session read buffer is full")
+	ErrTotalBufferFull       = errors.New("messages buffered across all sessions exceed the maximum")
 )
 
 // Session wrapper around websocket connections.
+// Sessions are compared by pointer identity, a *Session is safe to use as a
+// map key and stays the same for the lifetime of the connection.
 type Session struct {
-	Request *http.Request
-	conn    *websocket.Conn
-	output  chan *envelope
-	melody  *Melody
-	open    bool
-	rwmutex *sync.RWMutex
+	queued               int64 // Bytes waiting in output, kept first for 64-bit alignment.
+	writeWaitOverride    int64 // Set by SetWriteWait, kept with queued for 64-bit alignment.
+	initialWriteWait     int64 // Write wait of the next initialWrites messages.
+	slow                 int32 // One while output is past Config.SlowClientThreshold.
+	overflowing          int32 // Non-zero while the error handler reports ErrMessageBufferFull.
+	initialWrites        int32
+	id                   string
+	Request              *http.Request
+	conn                 *websocket.Conn
+	output               chan *envelope
+	melody               *Melody
+	open                 bool
+	reason               DisconnectReason
+	closer               closer
+	rwmutex              *sync.RWMutex
+	wmutex               sync.Mutex // Serializes every write to conn.
+	acks                 *ackTracker
+	wire                 *wireCounter
+	tls                  *tls.ConnectionState
+	compression          bool
+	inbound              *inboundQueue
+	reads                *readBuffer
+	reader               chan Message // Set by Reader, closed once readPump returns.
+	readerDone           bool
+	messageHandler       handleMessageFunc
+	messageHandlerBinary handleMessageFunc
+	reconfigure          chan struct{}
+	active               chan struct{} // Signals writePump that a message was read.
+	done                 chan struct{}
+	stopped              chan struct{} // Closed once writePump has returned.
+	finished             chan struct{} // Closed once teardown is complete.
+	connectedAt          time.Time
+	pingPeriodOverride   time.Duration
+	pongWaitOverride     time.Duration
+	outboundType         int // Message type used by Write, zero means text.
 }
 
 func (s *Session) writeMessage(message *envelope) error {
+	err := s.enqueue(message)
+	if err == ErrMessageBufferFull {
+		s.bufferFull()
+	} else if err != nil {
+		s.melody.errorHandler(s, err)
+	}
+
+	return err
+}
+
+// bufferFull reports ErrMessageBufferFull. Closing session from the error
+// handler discards the messages in the full buffer to queue the close frame
+// and ends the session with DisconnectBufferFull.
+func (s *Session) bufferFull() {
+	atomic.AddInt32(&s.overflowing, 1)
+	defer atomic.AddInt32(&s.overflowing, -1)
+
+	s.melody.errorHandler(s, ErrMessageBufferFull)
+}
+
+// enqueue puts message in the output buffer without waiting or reporting errors.
+func (s *Session) enqueue(message *envelope) error {
 	if s.closed() {
-		s.melody.errorHandler(s, ErrWriteToClosedSession)
 		return ErrWriteToClosedSession
 	}
 
+	if s.melody.tooBig(message.msg) {
+		return ErrOutboundMessageTooBig
+	}
+
+	size := int64(len(message.msg))
+	if err := s.reserve(size); err != nil {
+		return err
+	}
+
 	select {
 	case s.output <- message:
 	default:
-		s.melody.errorHandler(s, ErrMessageBufferFull)
+		s.unreserve(size)
 		return ErrMessageBufferFull
 	}
 
+	s.checkSlow()
+
 	return nil
 }
 
-func (s *Session) writeRaw(message *envelope) error {
+// writeMessageTimeout is like writeMessage but waits up to timeout for room in
+// a full buffer before giving up.
+func (s *Session) writeMessageTimeout(message *envelope, timeout time.Duration) error {
+	if timeout <= 0 {
+		return s.writeMessage(message)
+	}
+
 	if s.closed() {
+		s.melody.errorHandler(s, ErrWriteToClosedSession)
 		return ErrWriteToClosedSession
 	}
 
-	s.conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
-	err := s.conn.WriteMessage(message.t, message.msg)
+	if s.melody.tooBig(message.msg) {
+		s.melody.errorHandler(s, ErrOutboundMessageTooBig)
+		return ErrOutboundMessageTooBig
+	}
 
-	if err != nil {
+	size := int64(len(message.msg))
+	if err := s.reserve(size); err != nil {
+		s.melody.errorHandler(s, err)
 		return err
 	}
 
+	expired, timer := newTimer(s.melody.config().clock(), timeout)
+	defer timer.Stop()
+
+	// Output is never closed, so the wait needs no lock and done ends it
+	// when the session closes meanwhile.
+	select {
+	case s.output <- message:
+	case <-s.done:
+		s.unreserve(size)
+		s.melody.errorHandler(s, ErrWriteToClosedSession)
+		return ErrWriteToClosedSession
+	case <-expired:
+		s.unreserve(size)
+		s.bufferFull()
+		return ErrMessageBufferFull
+	}
+
+	s.checkSlow()
+
+	return nil
+}
+
+// checkSlow fires the slow client handlers when the output queue of session
+// crosses Config.SlowClientThreshold, or drains back to half of it.
+func (s *Session) checkSlow() {
+	threshold := s.melody.config().SlowClientThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	n := len(s.output)
+
+	if n > threshold {
+		if atomic.CompareAndSwapInt32(&s.slow, 0, 1) && s.melody.config().SlowClientEnterHandler != nil {
+			s.melody.config().SlowClientEnterHandler(s)
+		}
+	} else if n <= threshold/2 {
+		if atomic.CompareAndSwapInt32(&s.slow, 1, 0) && s.melody.config().SlowClientLeaveHandler != nil {
+			s.melody.config().SlowClientLeaveHandler(s)
+		}
+	}
+}
+
+// reserve accounts size bytes against Config.MaxQueuedBytes and
+// Config.MaxTotalBufferedBytes. A message larger than a limit is still let
+// through an empty buffer.
+func (s *Session) reserve(size int64) error {
+	queued := atomic.AddInt64(&s.queued, size)
+
+	if max := s.melody.config().MaxQueuedBytes; max > 0 && queued > max && queued != size {
+		atomic.AddInt64(&s.queued, -size)
+		return ErrMessageBufferFull
+	}
+
+	buffered := atomic.AddInt64(&s.melody.buffered, size)
+
+	if max := s.melody.config().MaxTotalBufferedBytes; max > 0 && buffered > max && buffered != size {
+		s.unreserve(size)
+		return ErrTotalBufferFull
+	}
+
 	return nil
 }
 
+// unreserve gives back size bytes taken by reserve once they left the buffer.
+func (s *Session) unreserve(size int64) {
+	atomic.AddInt64(&s.queued, -size)
+	atomic.AddInt64(&s.melody.buffered, -size)
+}
+
+// unreserveAll gives back the bytes of messages left in the buffer when the
+// session was torn down.
+func (s *Session) unreserveAll() {
+	atomic.AddInt64(&s.melody.buffered, -atomic.SwapInt64(&s.queued, 0))
+}
+
+// writeRaw writes message to the connection and returns the number of bytes
+// that went out on the wire for it.
+func (s *Session) writeRaw(message *envelope) (int64, error) {
+	// A message deadline only applies while it is queued, see writePump. Cutting
+	// a write short would leave the connection unusable.
+	deadline := time.Now().Add(s.writeWait(message.t))
+
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+
+	// Check as late as possible, teardown may have closed conn under us.
+	if s.closed() {
+		return 0, ErrWriteToClosedSession
+	}
+
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return 0, s.writeError(err)
+	}
+
+	if message.compress != compressDefault {
+		s.conn.EnableWriteCompression(message.compress == compressOn)
+		defer s.conn.EnableWriteCompression(true)
+	}
+
+	before := atomic.LoadInt64(&s.wire.written)
+	if err := s.conn.WriteMessage(message.t, message.msg); err != nil {
+		return atomic.LoadInt64(&s.wire.written) - before, s.writeError(err)
+	}
+
+	if message.t == websocket.CloseMessage {
+		s.setCloser(closedBySelf)
+	}
+
+	return atomic.LoadInt64(&s.wire.written) - before, nil
+}
+
+// writeError reports a failed write on a session that was closed meanwhile as
+// ErrWriteToClosedSession rather than the underlying connection error.
+func (s *Session) writeError(err error) error {
+	if s.closed() {
+		return ErrWriteToClosedSession
+	}
+
+	return err
+}
+
 func (s *Session) closed() bool {
 	s.rwmutex.RLock()
 	defer s.rwmutex.RUnlock()
@@ -64,36 +272,96 @@ func (s *Session) closed() bool {
 	return !s.open
 }
 
+// setReason records why session is ending, the first reason given wins.
+func (s *Session) setReason(reason DisconnectReason) {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	if s.reason == DisconnectUnknown {
+		s.reason = reason
+	}
+}
+
+// setCloser records which side sent the first close frame, the first one
+// recorded wins.
+func (s *Session) setCloser(c closer) {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	if s.closer == closedByNone {
+		s.closer = c
+	}
+}
+
 func (s *Session) close() {
 	if !s.closed() {
 		s.rwmutex.Lock()
 		s.open = false
 		s.conn.Close()
-		close(s.output)
+		close(s.done)
 		s.rwmutex.Unlock()
 	}
 }
 
-func (s *Session) ping() {
-	s.writeRaw(&envelope{t: websocket.PingMessage, msg: []byte{}})
+func (s *Session) ping() error {
+	_, err := s.writeRaw(&envelope{t: websocket.PingMessage, msg: []byte{}})
+	if err == nil {
+		atomic.AddInt64(&s.melody.pings, 1)
+	}
+
+	return err
+}
+
+// writeFailed reports err from writing the connection and closes it, so a
+// readPump blocked on a connection that can still be read from gives up at
+// once instead of at the read deadline.
+func (s *Session) writeFailed(err error) {
+	s.setReason(DisconnectWriteError)
+	s.melody.errorHandler(s, err)
+	s.conn.Close()
 }
 
 func (s *Session) writePump() {
-	ticker := time.NewTicker(s.melody.Config.PingPeriod)
-	defer ticker.Stop()
+	ticker := s.newPingTicker()
+	defer func() {
+		ticker.Stop()
+	}()
 
 loop:
 	for {
 		select {
-		case msg, ok := <-s.output:
-			if !ok {
-				break loop
+		case <-s.done:
+			break loop
+		case msg := <-s.output:
+			if msg.marker {
+				msg.flushed <- nil
+				continue
+			}
+
+			if !msg.deadline.IsZero() && s.melody.config().clock().Now().After(msg.deadline) {
+				s.unreserve(int64(len(msg.msg)))
+				if msg.flushed != nil {
+					msg.flushed <- ErrWriteTimeout
+				}
+				msg.release()
+				continue
+			}
+
+			written, err := s.writeRaw(msg)
+			s.unreserve(int64(len(msg.msg)))
+
+			if msg.flushed != nil {
+				msg.flushed <- err
 			}
 
-			err := s.writeRaw(msg)
+			if err == ErrWriteToClosedSession {
+				msg.release()
+				break loop
+			}
 
 			if err != nil {
-				s.melody.errorHandler(s, err)
+				s.writeFailed(err)
+				msg.release()
 				break loop
 			}
 
@@ -101,6 +369,8 @@ loop:
 				break loop
 			}
 
+			s.checkSlow()
+
 			if msg.t == websocket.TextMessage {
 				s.melody.messageSentHandler(s, msg.msg)
 			}
@@ -108,75 +378,777 @@ loop:
 			if msg.t == websocket.BinaryMessage {
 				s.melody.messageSentHandlerBinary(s, msg.msg)
 			}
-		case <-ticker.C:
-			s.ping()
+
+			s.melody.sentInfoHandler(s, SentMessage{Type: msg.t, Msg: msg.msg, WireBytes: written, Context: msg.context(), Meta: msg.meta})
+
+			msg.release()
+		case <-ticker.C():
+			if err := s.ping(); err != nil && err != ErrWriteToClosedSession {
+				s.writeFailed(err)
+				break loop
+			}
+
+			if idle, ok := ticker.(*idleTicker); ok {
+				idle.rearm(s.pingPeriod())
+			}
+		case <-s.reconfigure:
+			ticker.Stop()
+			ticker = s.newPingTicker()
+		case <-s.active:
+			if idle, ok := ticker.(*idleTicker); ok {
+				idle.rearm(s.pingPeriod())
+			}
 		}
 	}
 }
 
-func (s *Session) readPump() {
-	s.conn.SetReadLimit(s.melody.Config.MaxMessageSize)
-	s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
+// newPingTicker returns the ticker writePump pings session on.
+func (s *Session) newPingTicker() Ticker {
+	if s.melody.config().PingOnlyWhenIdle {
+		return newIdleTicker(s.melody.config().clock(), s.pingPeriod())
+	}
+
+	return s.melody.config().clock().NewTicker(s.pingPeriod())
+}
+
+func (s *Session) readPump() error {
+	// Gorilla treats a zero read limit as no limit, as Config documents.
+	limit := s.melody.config().MaxMessageSize
+	s.conn.SetReadLimit(limit)
+	s.conn.SetReadDeadline(time.Now().Add(s.pongWait()))
 
 	s.conn.SetPongHandler(func(string) error {
-		s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
+		s.conn.SetReadDeadline(time.Now().Add(s.pongWait()))
+		atomic.AddInt64(&s.melody.pongs, 1)
 		s.melody.pongHandler(s)
 		return nil
 	})
 
+	s.conn.SetPingHandler(func(appData string) error {
+		var payload []byte
+		if s.melody.config().EchoPingPayload {
+			payload = []byte(appData)
+		}
+
+		// Like gorilla's default handler, only errors that leave the
+		// connection unusable fail the read.
+		err := s.writeControl(websocket.PongMessage, payload)
+		if err == websocket.ErrCloseSent || err == ErrWriteToClosedSession {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+
 	if s.melody.closeHandler != nil {
 		s.conn.SetCloseHandler(func(code int, text string) error {
+			// Recorded first, a close frame sent back from the handler is
+			// only a reply.
+			s.setCloser(closedByPeer)
 			return s.melody.closeHandler(s, code, text)
 		})
+	} else if s.melody.config().DrainOnClose {
+		// The close frame is answered by drain once the buffer is flushed.
+		s.conn.SetCloseHandler(func(int, string) error {
+			return nil
+		})
+	}
+
+	maxRate := s.melody.config().MaxMessagesPerSecond
+	window := newRateWindow(maxRate)
+
+	if s.reads != nil {
+		go s.reads.run(s)
+		defer s.reads.stop()
 	}
 
+	defer s.closeReader()
+
 	for {
+		if max := s.melody.config().MaxMessageSize; max != limit {
+			limit = max
+			s.conn.SetReadLimit(limit)
+		}
+
+		if max := s.melody.config().MaxMessagesPerSecond; max != maxRate {
+			maxRate = max
+			window = newRateWindow(maxRate)
+		}
+
+		if s.melody.messageReaderHandler != nil {
+			t, r, err := s.conn.NextReader()
+			if err != nil {
+				return s.readFailed(err)
+			}
+
+			if window != nil {
+				if rate, exceeded := window.hit(s.melody.config().clock().Now()); exceeded {
+					return s.rateExceeded(rate)
+				}
+			}
+
+			s.readActive()
+			s.melody.messageReaderHandler(s, t, r)
+			io.Copy(ioutil.Discard, r)
+			continue
+		}
+
 		t, message, err := s.conn.ReadMessage()
 
 		if err != nil {
-			s.melody.errorHandler(s, err)
-			break
+			return s.readFailed(err)
 		}
 
-		if t == websocket.TextMessage {
-			s.melody.messageHandler(s, message)
+		if window != nil {
+			if rate, exceeded := window.hit(s.melody.config().clock().Now()); exceeded {
+				return s.rateExceeded(rate)
+			}
 		}
 
-		if t == websocket.BinaryMessage {
-			s.melody.messageHandlerBinary(s, message)
+		s.readActive()
+
+		if t == websocket.TextMessage && s.acks.active() {
+			if id, ok := s.melody.config().ackParse()(message); ok {
+				if onAck, ok := s.acks.remove(id); ok {
+					if onAck != nil {
+						onAck()
+					}
+					s.melody.ackHandler(s, id)
+				}
+				continue
+			}
+		}
+
+		if reader := s.activeReader(); reader != nil {
+			if err := s.pushReader(reader, t, message); err != nil {
+				return err
+			}
+		} else if s.inbound != nil {
+			s.inbound.push(s, t, message)
+		} else if s.reads != nil {
+			if !s.reads.push(t, message) {
+				return s.readBufferFull()
+			}
+		} else {
+			s.dispatch(t, message)
+		}
+	}
+}
+
+// readActive treats a message read from session like a pong when
+// Config.PingOnlyWhenIdle is set, extending the read deadline and putting off
+// the next ping.
+func (s *Session) readActive() {
+	if !s.melody.config().PingOnlyWhenIdle {
+		return
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(s.pongWait()))
+
+	select {
+	case s.active <- struct{}{}:
+	default:
+	}
+}
+
+// readFailed reports err from reading the connection. Any read error ends the
+// session, the read loop never retries a failed read.
+func (s *Session) readFailed(err error) error {
+	reason := readErrorReason(err)
+	s.setReason(reason)
+
+	if reason == DisconnectClientClose {
+		s.setCloser(closedByPeer)
+	}
+
+	if websocket.IsCloseError(err, CloseInvalidFramePayloadData) {
+		s.melody.errorHandler(s, ErrInvalidUTF8)
+	} else {
+		s.melody.errorHandler(s, err)
+	}
+
+	if backoff := s.melody.config().ReadErrorBackoff; backoff > 0 && reason != DisconnectClientClose {
+		time.Sleep(backoff)
+	}
+
+	return err
+}
+
+// rateExceeded closes a session that sent messages faster than
+// Config.MaxMessagesPerSecond. The close frame is written straight to the
+// connection so it goes out before the session is torn down.
+func (s *Session) rateExceeded(rate float64) error {
+	s.setReason(DisconnectRateExceeded)
+	s.writeControl(websocket.CloseMessage, FormatCloseMessage(ClosePolicyViolation, "message rate exceeded"))
+	s.melody.rateExceededHandler(s, rate)
+
+	return ErrRateExceeded
+}
+
+// readBufferFull closes a session that filled its Config.ReadBufferMessages
+// buffer under ReadBufferDisconnect.
+func (s *Session) readBufferFull() error {
+	s.setReason(DisconnectBufferFull)
+	s.writeControl(websocket.CloseMessage, FormatCloseMessage(CloseTryAgainLater, "read buffer full"))
+	s.melody.errorHandler(s, ErrReadBufferFull)
+
+	return ErrReadBufferFull
+}
+
+// lifetimeExceeded closes a session that was connected for longer than
+// Config.MaxConnectionLifetime.
+func (s *Session) lifetimeExceeded() {
+	code := s.melody.config().LifetimeCloseCode
+	if code == 0 {
+		code = CloseGoingAway
+	}
+
+	s.setReason(DisconnectLifetimeExceeded)
+	s.closeNow(FormatCloseMessage(code, "connection lifetime exceeded"))
+}
+
+// dispatch fires the message handler for a message read from the session,
+// preferring a handler set on the session over the melody instance's.
+func (s *Session) dispatch(t int, message []byte) {
+	defer s.watch()()
+
+	s.rwmutex.RLock()
+	messageHandler, messageHandlerBinary := s.messageHandler, s.messageHandlerBinary
+	s.rwmutex.RUnlock()
+
+	if t == websocket.TextMessage || t == websocket.BinaryMessage {
+		var ok bool
+		if message, ok = s.runMiddleware(message); !ok {
+			return
+		}
+
+		if s.melody.config().Echo {
+			if !s.melody.config().EchoAfterHandlers {
+				s.echo(t, message)
+				return
+			}
+			defer s.echo(t, message)
+		}
+	}
+
+	switch t {
+	case websocket.TextMessage:
+		if s.route(message) {
+			return
+		}
+
+		if messageHandler == nil {
+			messageHandler = s.melody.protocolHandler(s.melody.protocolHandlers, s.melody.messageHandler, s)
+		}
+		messageHandler(s, message)
+	case websocket.BinaryMessage:
+		if s.routeBinary(message) {
+			return
 		}
+
+		if messageHandlerBinary == nil {
+			messageHandlerBinary = s.melody.protocolHandler(s.melody.protocolHandlersBinary, s.melody.messageHandlerBinary, s)
+		}
+		messageHandlerBinary(s, message)
+	default:
+		if fn := s.melody.config().UnknownMessageHandler; fn != nil {
+			fn(s, t, message)
+		}
+	}
+}
+
+// echo writes message back to session as the same type when Config.Echo is
+// set, unless it is larger than Config.EchoMaxSize.
+func (s *Session) echo(t int, message []byte) {
+	if max := s.melody.config().EchoMaxSize; max > 0 && int64(len(message)) > max {
+		return
+	}
+
+	e := newEnvelope(t, message)
+	if s.writeMessage(e) != nil {
+		e.release()
 	}
 }
 
-// Write writes message to session.
+// drain answers a close frame from the peer through the output buffer, so
+// messages queued before it are still written. It gives up after WriteWait.
+func (s *Session) drain(err error) {
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		return
+	}
+
+	payload := []byte{}
+	if closeErr.Code != CloseNoStatusReceived {
+		payload = FormatCloseMessage(closeErr.Code, "")
+	}
+
+	timeout := s.melody.config().WriteWait
+	message := &envelope{t: websocket.CloseMessage, msg: payload, flushed: make(chan error, 1)}
+	if s.writeMessageTimeout(message, timeout) != nil {
+		return
+	}
+
+	expired, timer := newTimer(s.melody.config().clock(), timeout)
+	defer timer.Stop()
+
+	select {
+	case <-message.flushed:
+	case <-expired:
+	}
+}
+
+// Write writes message to session as a text message, or as the type set with
+// SetOutboundType.
+// The message is only buffered when Write returns, so n is the number of
+// bytes queued rather than sent. Use WriteFlushed to wait for the message to
+// reach the connection.
 func (s *Session) Write(msg []byte) (n int, err error) {
 	if s.closed() {
 		return 0, ErrSessionClosed
 	}
 
-	err = s.writeMessage(&envelope{t: websocket.TextMessage, msg: msg})
+	message := newEnvelope(s.writeType(), msg)
+	err = s.writeMessage(message)
 	if err == nil {
 		n = len(msg)
+	} else {
+		message.release()
 	}
 	return
 }
 
+// WriteWithMeta writes message to session like Write and attaches meta to it,
+// ie: a message ID. meta is passed to the HandleSentMessageInfo handler once
+// the message has been written.
+func (s *Session) WriteWithMeta(msg []byte, meta interface{}) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	message := newEnvelope(s.writeType(), msg)
+	message.meta = meta
+	err := s.writeMessage(message)
+	if err != nil {
+		message.release()
+	}
+
+	return err
+}
+
+// WriteText writes a text message to session regardless of SetOutboundType,
+// symmetric with WriteBinary.
+func (s *Session) WriteText(msg []byte) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	message := newEnvelope(websocket.TextMessage, msg)
+	err := s.writeMessage(message)
+	if err != nil {
+		message.release()
+	}
+
+	return err
+}
+
+// WriteJSON writes v encoded as JSON to session like Write, as a text message
+// unless SetOutboundType says otherwise.
+func (s *Session) WriteJSON(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Write(msg)
+	return err
+}
+
+// WriteError writes an error with code and message to session as a text
+// message formatted by Config.ErrorFormat.
+func (s *Session) WriteError(code int, message string) error {
+	return s.WriteText(s.melody.config().errorFormat()(code, message))
+}
+
+// WriteErrorAndClose writes an error like WriteError, waits until it has been
+// written to the connection and then closes session with a normal closure
+// close code.
+func (s *Session) WriteErrorAndClose(code int, message string) error {
+	if _, err := s.WriteFlushed(s.melody.config().errorFormat()(code, message)); err != nil {
+		return err
+	}
+
+	return s.Close()
+}
+
+// WriteFlushed writes message to session and waits until it has been written
+// to the connection, n is the number of bytes sent.
+func (s *Session) WriteFlushed(msg []byte) (n int, err error) {
+	if s.closed() {
+		return 0, ErrSessionClosed
+	}
+
+	if err = s.writeFlushed(&envelope{t: websocket.TextMessage, msg: msg}); err != nil {
+		return 0, err
+	}
+
+	return len(msg), nil
+}
+
+// WriteDeadline writes message to session and waits until it has been
+// written to the connection. If it is still queued at deadline it is dropped
+// and ErrWriteTimeout is returned.
+func (s *Session) WriteDeadline(msg []byte, deadline time.Time) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeFlushed(&envelope{t: websocket.TextMessage, msg: msg, deadline: deadline})
+}
+
+// WriteBinaryDeadline is like WriteDeadline but writes a binary message.
+func (s *Session) WriteBinaryDeadline(msg []byte, deadline time.Time) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeFlushed(&envelope{t: websocket.BinaryMessage, msg: msg, deadline: deadline})
+}
+
+// writeFlushed writes message and waits for it to reach the connection, or
+// for its deadline to pass.
+func (s *Session) writeFlushed(message *envelope) error {
+	message.flushed = make(chan error, 1)
+	if err := s.writeMessage(message); err != nil {
+		return err
+	}
+
+	var timeout <-chan struct{}
+	if !message.deadline.IsZero() {
+		clock := s.melody.config().clock()
+		expired, timer := newTimer(clock, message.deadline.Sub(clock.Now()))
+		defer timer.Stop()
+		timeout = expired
+	}
+
+	select {
+	case err := <-message.flushed:
+		return err
+	case <-timeout:
+		return ErrWriteTimeout
+	case <-s.done:
+		select {
+		case err := <-message.flushed:
+			return err
+		default:
+			return ErrSessionClosed
+		}
+	}
+}
+
+// Flush waits until every message queued on session before the call has been
+// written to the connection, or until ctx is done.
+func (s *Session) Flush(ctx context.Context) error {
+	marker := &envelope{marker: true, flushed: make(chan error, 1)}
+
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	// Nothing takes from output once writePump has returned, so stopped
+	// ends the wait as well as done.
+	select {
+	case s.output <- marker:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return ErrSessionClosed
+	case <-s.stopped:
+		return ErrSessionClosed
+	}
+
+	select {
+	case <-marker.flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return markerFlushed(marker)
+	case <-s.stopped:
+		return markerFlushed(marker)
+	}
+}
+
+// markerFlushed reports whether marker got through before the session stopped
+// writing.
+func markerFlushed(marker *envelope) error {
+	select {
+	case <-marker.flushed:
+		return nil
+	default:
+		return ErrSessionClosed
+	}
+}
+
 // WriteBinary writes a binary message to session.
 func (s *Session) WriteBinary(msg []byte) error {
 	if s.closed() {
 		return ErrSessionClosed
 	}
 
-	return s.writeMessage(&envelope{t: websocket.BinaryMessage, msg: msg})
+	message := newEnvelope(websocket.BinaryMessage, msg)
+	err := s.writeMessage(message)
+	if err != nil {
+		message.release()
+	}
+
+	return err
+}
+
+// WriteCompressed writes a text message to session, compress controls whether
+// it is compressed. Compression only applies when it was negotiated with the
+// session, see Upgrader.EnableCompression.
+func (s *Session) WriteCompressed(msg []byte, compress bool) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeMessage(&envelope{t: websocket.TextMessage, msg: msg, compress: compressionFor(compress)})
+}
+
+// WriteBinaryCompressed is like WriteCompressed but writes a binary message.
+func (s *Session) WriteBinaryCompressed(msg []byte, compress bool) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeMessage(&envelope{t: websocket.BinaryMessage, msg: msg, compress: compressionFor(compress)})
+}
+
+// WriteReliable writes a text message to session tagged with a sequence id
+// using Config.AckFormat. When the session answers with an acknowledgement
+// recognized by Config.AckParse the HandleAck handler fires, if no
+// acknowledgement arrives within Config.AckTimeout HandleAckTimeout fires.
+func (s *Session) WriteReliable(msg []byte) (id uint64, err error) {
+	return s.writeReliable(msg, nil)
+}
+
+// writeReliable is WriteReliable firing onAck, if set, on acknowledgement.
+func (s *Session) writeReliable(msg []byte, onAck func()) (id uint64, err error) {
+	if s.closed() {
+		return 0, ErrSessionClosed
+	}
+
+	id = s.acks.add(s.melody.config().clock(), s.melody.config().AckTimeout, func(id uint64) {
+		s.melody.ackTimeoutHandler(s, id)
+	}, onAck)
+
+	err = s.writeMessage(&envelope{t: websocket.TextMessage, msg: s.melody.config().ackFormat()(id, msg)})
+	if err != nil {
+		s.acks.remove(id)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Unacked returns the number of reliable messages waiting on an acknowledgement.
+func (s *Session) Unacked() int {
+	return s.acks.len()
+}
+
+// QueueLen returns the number of messages waiting to be written to session.
+func (s *Session) QueueLen() int {
+	return len(s.output)
+}
+
+// QueuedBytes returns the number of bytes waiting to be written to session.
+func (s *Session) QueuedBytes() int64 {
+	return atomic.LoadInt64(&s.queued)
+}
+
+// BytesWritten returns the number of bytes written to the connection of
+// session, including the upgrade response, framing and compression. Unlike
+// QueuedBytes it counts what actually went out on the wire.
+func (s *Session) BytesWritten() int64 {
+	return atomic.LoadInt64(&s.wire.written)
+}
+
+// BytesRead returns the number of bytes read from the connection of session,
+// including framing and compression. Bytes read before the upgrade, and all
+// reads if Upgrader.ReadBufferSize is zero, are not counted as the HTTP
+// server's own buffered reader is reused then.
+func (s *Session) BytesRead() int64 {
+	return atomic.LoadInt64(&s.wire.read)
+}
+
+// IsWritable reports whether session is open and has room in its buffer for
+// another message.
+func (s *Session) IsWritable() bool {
+	if s.closed() {
+		return false
+	}
+
+	if max := s.melody.config().MaxQueuedBytes; max > 0 && atomic.LoadInt64(&s.queued) >= max {
+		return false
+	}
+
+	return len(s.output) < cap(s.output)
+}
+
+// TryWrite writes message to session if it can be buffered without dropping
+// it and reports whether it was. Unlike Write it does not fire the error handler.
+func (s *Session) TryWrite(msg []byte) bool {
+	message := newEnvelope(websocket.TextMessage, msg)
+	if s.enqueue(message) != nil {
+		message.release()
+		return false
+	}
+
+	return true
+}
+
+// SetMessageHandler overrides the HandleMessage handler for this session only,
+// a nil fn restores it.
+func (s *Session) SetMessageHandler(fn func(*Session, []byte)) {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	s.messageHandler = fn
+}
+
+// SetMessageHandlerBinary overrides the HandleMessageBinary handler for this
+// session only, a nil fn restores it.
+func (s *Session) SetMessageHandlerBinary(fn func(*Session, []byte)) {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	s.messageHandlerBinary = fn
+}
+
+// SetOutboundType sets the message type Write sends for this session,
+// websocket.TextMessage (the default) or websocket.BinaryMessage.
+func (s *Session) SetOutboundType(messageType int) error {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return ErrInvalidOutboundType
+	}
+
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	s.outboundType = messageType
+
+	return nil
+}
+
+func (s *Session) writeType() int {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	if s.outboundType == 0 {
+		return websocket.TextMessage
+	}
+
+	return s.outboundType
+}
+
+// SetPingPeriod overrides Config.PingPeriod for this session only and re-arms
+// its ping ticker, zero restores the global setting.
+func (s *Session) SetPingPeriod(period time.Duration) {
+	s.rwmutex.Lock()
+	s.pingPeriodOverride = period
+	s.rwmutex.Unlock()
+
+	select {
+	case s.reconfigure <- struct{}{}:
+	default:
+	}
+}
+
+// SetPongWait overrides Config.PongWait for this session only and re-arms its
+// read deadline, zero restores the global setting.
+func (s *Session) SetPongWait(wait time.Duration) {
+	s.rwmutex.Lock()
+	s.pongWaitOverride = wait
+	s.rwmutex.Unlock()
+
+	s.conn.SetReadDeadline(time.Now().Add(s.pongWait()))
+}
+
+// SetWriteWait overrides Config.WriteWait for this session only, zero restores
+// the global setting.
+func (s *Session) SetWriteWait(wait time.Duration) {
+	atomic.StoreInt64(&s.writeWaitOverride, int64(wait))
+}
+
+// SetInitialWriteWait overrides the write wait of the next n text and binary
+// messages written to session, ie: to give up quickly on a welcome message
+// set from HandleConnect. Later messages use the SetWriteWait or global one.
+func (s *Session) SetInitialWriteWait(wait time.Duration, n int) {
+	atomic.StoreInt64(&s.initialWriteWait, int64(wait))
+	atomic.StoreInt32(&s.initialWrites, int32(n))
+}
+
+func (s *Session) pingPeriod() time.Duration {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	if s.pingPeriodOverride > 0 {
+		return s.pingPeriodOverride
+	}
+
+	return s.melody.config().PingPeriod
+}
+
+func (s *Session) pongWait() time.Duration {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	if s.pongWaitOverride > 0 {
+		return s.pongWaitOverride
+	}
+
+	return s.melody.config().PongWait
+}
+
+// Ping sends a ping to session right away, bypassing the message buffer.
+func (s *Session) Ping() error {
+	return s.PingWithPayload([]byte{})
 }
 
-// Close closes session.
+// PingWithPayload sends a ping with payload to session right away, bypassing
+// the message buffer. The payload must be at most 125 bytes.
+func (s *Session) PingWithPayload(payload []byte) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeControl(websocket.PingMessage, payload)
+}
+
+// WritePong sends an unsolicited pong control frame with payload to session
+// right away, bypassing the message buffer. Pings from the session are
+// already answered automatically, and clients that can't see control frames
+// need a data message written with Write instead. The payload must be at most
+// 125 bytes.
+func (s *Session) WritePong(payload []byte) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	return s.writeControl(websocket.PongMessage, payload)
+}
+
+// Close closes session with a normal closure close code. Called from the
+// error handler for ErrMessageBufferFull it discards the buffered messages to
+// make room for the close frame, see DisconnectBufferFull.
 func (s *Session) Close() error {
 	if s.closed() {
 		return ErrSessionAlreadyClosed
 	}
 
-	return s.writeMessage(&envelope{t: websocket.CloseMessage, msg: []byte{}})
+	return s.kick(FormatCloseMessage(CloseNormalClosure, ""))
 }
 
 // CloseWithMsg closes the session with the provided payload.
@@ -186,7 +1158,206 @@ func (s *Session) CloseWithMsg(msg []byte) error {
 		return ErrSessionAlreadyClosed
 	}
 
-	return s.writeMessage(&envelope{t: websocket.CloseMessage, msg: msg})
+	return s.kick(msg)
+}
+
+// kick queues a close frame with msg, the session only counts as kicked once
+// it is queued so a failed close leaves it open as it was.
+func (s *Session) kick(msg []byte) error {
+	if atomic.LoadInt32(&s.overflowing) > 0 {
+		s.discardQueued()
+		if err := s.enqueue(&envelope{t: websocket.CloseMessage, msg: msg}); err != nil {
+			return err
+		}
+
+		s.setReason(DisconnectBufferFull)
+		return nil
+	}
+
+	err := s.writeMessage(&envelope{t: websocket.CloseMessage, msg: msg})
+	if err == nil {
+		s.setReason(DisconnectKicked)
+	}
+
+	return err
+}
+
+// discardQueued drops the messages waiting in the output buffer.
+func (s *Session) discardQueued() {
+	for {
+		select {
+		case msg := <-s.output:
+			// Flush learns of the close from stopped instead.
+			if msg.marker {
+				continue
+			}
+
+			s.unreserve(int64(len(msg.msg)))
+			if msg.flushed != nil {
+				msg.flushed <- ErrSessionClosed
+			}
+			msg.release()
+		default:
+			return
+		}
+	}
+}
+
+// closeNow queues a close frame with msg, or writes it straight to the
+// connection if the buffer is full.
+func (s *Session) closeNow(msg []byte) error {
+	if s.closed() {
+		return ErrSessionAlreadyClosed
+	}
+
+	if s.enqueue(&envelope{t: websocket.CloseMessage, msg: msg}) == nil {
+		return nil
+	}
+
+	return s.writeControl(websocket.CloseMessage, msg)
+}
+
+// writeControl writes a control message straight to the connection, bypassing
+// the output buffer.
+func (s *Session) writeControl(t int, msg []byte) error {
+	if s.closed() {
+		return ErrWriteToClosedSession
+	}
+
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+
+	if err := s.conn.WriteControl(t, msg, time.Now().Add(s.writeWait(t))); err != nil {
+		return err
+	}
+
+	if t == websocket.CloseMessage {
+		s.setCloser(closedBySelf)
+	}
+
+	return nil
+}
+
+// writeWait returns how long writing a message of type t may take. Text and
+// binary messages use up the writes left of SetInitialWriteWait.
+func (s *Session) writeWait(t int) time.Duration {
+	if t == websocket.CloseMessage && s.melody.config().CloseWait > 0 {
+		return s.melody.config().CloseWait
+	}
+
+	if t == websocket.TextMessage || t == websocket.BinaryMessage {
+		for {
+			n := atomic.LoadInt32(&s.initialWrites)
+			if n <= 0 {
+				break
+			}
+			if atomic.CompareAndSwapInt32(&s.initialWrites, n, n-1) {
+				return time.Duration(atomic.LoadInt64(&s.initialWriteWait))
+			}
+		}
+	}
+
+	if wait := atomic.LoadInt64(&s.writeWaitOverride); wait > 0 {
+		return time.Duration(wait)
+	}
+
+	return s.melody.config().WriteWait
+}
+
+// CompressionEnabled reports whether permessage-deflate compression was
+// negotiated with session when it was upgraded.
+func (s *Session) CompressionEnabled() bool {
+	return s.compression
+}
+
+// deflateExtension is the Sec-WebSocket-Extensions value gorilla answers with
+// when it accepts permessage-deflate, the only extension it negotiates.
+const deflateExtension = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// Extensions returns the Sec-WebSocket-Extensions negotiated with session in
+// its handshake response, with their parameters, or nil if none were. A proxy
+// that strips the extension offer from the request shows up as none here.
+func (s *Session) Extensions() []string {
+	if s.compression {
+		return []string{deflateExtension}
+	}
+
+	return nil
+}
+
+// TLS returns the TLS state of the connection of session as it was upgraded,
+// or nil if it didn't use TLS. Client certificates verified by the server
+// are in its PeerCertificates and VerifiedChains.
+func (s *Session) TLS() *tls.ConnectionState {
+	return s.tls
+}
+
+// NetConn returns the network connection underlying session, ie: a
+// *net.TCPConn to set TCP_NODELAY or keepalive on. Reading from or writing to
+// it directly corrupts the websocket stream.
+func (s *Session) NetConn() net.Conn {
+	conn := s.conn.UnderlyingConn()
+	if c, ok := conn.(*countingConn); ok {
+		return c.Conn
+	}
+
+	return conn
+}
+
+// Subprotocol returns the subprotocol negotiated for the session, or an empty
+// string if none was.
+func (s *Session) Subprotocol() string {
+	return s.conn.Subprotocol()
+}
+
+// Join adds session to room.
+func (s *Session) Join(room string) error {
+	if !s.melody.hub.join(s, room) {
+		return ErrSessionClosed
+	}
+
+	return nil
+}
+
+// JoinWithPriority adds session to room like Join, with a priority for room
+// broadcasts: sessions that joined with one are sent them first, highest
+// priority first, before the rest of the room in no particular order.
+// Priority only orders when messages are queued on each session, it isn't
+// a guarantee of which client receives them first. Joining again updates the
+// priority, Join keeps it.
+func (s *Session) JoinWithPriority(room string, priority int) error {
+	if !s.melody.hub.joinPriority(s, room, priority) {
+		return ErrSessionClosed
+	}
+
+	return nil
+}
+
+// Leave removes session from room.
+func (s *Session) Leave(room string) {
+	if s.melody.hub.leave(s, room) {
+		s.melody.roomEmptyHandler(room)
+	}
+}
+
+// AddTag labels session with tag, see Melody.BroadcastToTag. Unlike rooms
+// tags carry no events, a session can have any number of them.
+func (s *Session) AddTag(tag string) error {
+	if !s.melody.hub.addTag(s, tag) {
+		return ErrSessionClosed
+	}
+
+	return nil
+}
+
+// RemoveTag removes tag from session.
+func (s *Session) RemoveTag(tag string) {
+	s.melody.hub.removeTag(s, tag)
+}
+
+// Tags returns the tags of session.
+func (s *Session) Tags() []string {
+	return s.melody.hub.sessionTags(s)
 }
 
 // Set is used to store a new key/value pair exclusivelly for this session.
@@ -195,6 +1366,12 @@ func (s *Session) Set(key string, value interface{}) {
 	s.Request = newRequestWithContextKey(s.Request, key, value)
 }
 
+// SetMulti stores every key/value pair in keys for this session at once,
+// rebuilding the session request a single time instead of once per key.
+func (s *Session) SetMulti(keys map[string]interface{}) {
+	s.Request = newRequestWithContextKeys(s.Request, keys)
+}
+
 // Get returns the value for the given key, ie: (value, true).
 // If the value does not exists it returns (nil, false)
 func (s *Session) Get(key string) (value interface{}, exists bool) {
@@ -211,7 +1388,61 @@ func (s *Session) MustGet(key string) interface{} {
 	panic("Key \"" + key + "\" does not exist")
 }
 
+// ID returns the ID given to session by Config.IDGenerator when it connected,
+// or the one restored by Melody.ImportState.
+func (s *Session) ID() string {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.id
+}
+
+// Equal reports whether s and other are the same session.
+func (s *Session) Equal(other *Session) bool {
+	return s == other
+}
+
+// ConnectedAt returns when the session connected.
+func (s *Session) ConnectedAt() time.Time {
+	return s.connectedAt
+}
+
+// Age returns how long the session has been connected.
+func (s *Session) Age() time.Duration {
+	return s.melody.config().clock().Now().Sub(s.connectedAt)
+}
+
+// Done returns a channel that is closed once the session has been torn down,
+// ie: both pumps have exited and the HandleDisconnect handler has run.
+func (s *Session) Done() <-chan struct{} {
+	return s.finished
+}
+
+// WaitClosed blocks until the session has been torn down, see Done.
+func (s *Session) WaitClosed() {
+	<-s.finished
+}
+
 // IsClosed returns the status of the connection.
 func (s *Session) IsClosed() bool {
 	return s.closed()
 }
+
+// ClosedByPeer reports whether the session sent a close frame before one was
+// sent to it, ie: the peer started the close handshake. It is false for a
+// connection that dropped without a close frame.
+func (s *Session) ClosedByPeer() bool {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.closer == closedByPeer
+}
+
+// DisconnectReason returns why the session ended, or DisconnectUnknown while
+// it is still open.
+func (s *Session) DisconnectReason() DisconnectReason {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.reason
+}
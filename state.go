@@ -0,0 +1,62 @@
+package melody
+
+// SessionState is a snapshot of the metadata of a session, see Session.Export
+// and Melody.ImportState. Keys only survive serialization if their values do.
+type SessionState struct {
+	ID    string                 `json:"id"`
+	Keys  map[string]interface{} `json:"keys"`
+	Tags  []string               `json:"tags"`
+	Rooms []string               `json:"rooms"`
+}
+
+// Export returns a snapshot of the ID, keys, tags and rooms of session.
+func (s *Session) Export() SessionState {
+	state := SessionState{
+		ID:    s.ID(),
+		Keys:  make(map[string]interface{}),
+		Tags:  s.Tags(),
+		Rooms: s.melody.hub.sessionRooms(s),
+	}
+
+	names, _ := s.Request.Context().Value(keyNamesKey{}).([]string)
+	for _, name := range names {
+		if value, exists := s.Get(name); exists {
+			state.Keys[name] = value
+		}
+	}
+
+	return state
+}
+
+// ImportState restores a snapshot taken with Session.Export, possibly on
+// another melody instance, onto session s. The ID of s is replaced, keys are
+// set and s is tagged with the tags and joins the rooms of the snapshot.
+func (m *Melody) ImportState(s *Session, state SessionState) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	if state.ID != "" {
+		s.rwmutex.Lock()
+		s.id = state.ID
+		s.rwmutex.Unlock()
+	}
+
+	if len(state.Keys) > 0 {
+		s.SetMulti(state.Keys)
+	}
+
+	for _, tag := range state.Tags {
+		if err := s.AddTag(tag); err != nil {
+			return err
+		}
+	}
+
+	for _, room := range state.Rooms {
+		if err := s.Join(room); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
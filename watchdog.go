@@ -0,0 +1,48 @@
+package melody
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrHandlerTimeout = errors.New("message handler ran longer than config handler timeout")
+)
+
+// HandlerTimeoutPolicy decides what happens when handling a message takes
+// longer than Config.HandlerTimeout.
+type HandlerTimeoutPolicy int
+
+// Policies for a handler that exceeded Config.HandlerTimeout.
+const (
+	HandlerTimeoutWarn  HandlerTimeoutPolicy = iota // Pass ErrHandlerTimeout to the HandleError handler.
+	HandlerTimeoutClose                             // Also close the connection with CloseInternalServerErr, teardown still waits for the handler to return.
+)
+
+// watch arms the Config.HandlerTimeout watchdog for handling one message of
+// session and returns the func that disarms it.
+func (s *Session) watch() func() {
+	timeout := s.melody.config().HandlerTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	timer := s.melody.config().clock().AfterFunc(timeout, s.handlerTimedOut)
+
+	return func() {
+		timer.Stop()
+	}
+}
+
+func (s *Session) handlerTimedOut() {
+	s.melody.errorHandler(s, ErrHandlerTimeout)
+
+	if s.melody.config().HandlerTimeoutPolicy != HandlerTimeoutClose {
+		return
+	}
+
+	s.setReason(DisconnectHandlerTimeout)
+	s.writeControl(websocket.CloseMessage, FormatCloseMessage(CloseInternalServerErr, "handler timeout"))
+	s.conn.Close()
+}
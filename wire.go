@@ -0,0 +1,60 @@
+package melody
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// wireCounter counts the bytes that crossed a connection, framing and
+// compression included.
+type wireCounter struct {
+	read    int64
+	written int64
+}
+
+// countingConn counts the bytes read from and written to a net.Conn.
+type countingConn struct {
+	net.Conn
+	counter *wireCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.counter.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.counter.written, int64(n))
+	return n, err
+}
+
+// countingResponseWriter hands the upgrader a countingConn when it hijacks
+// the connection.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter *wireCounter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &countingConn{Conn: conn, counter: w.counter}, brw, nil
+}
+
+// countWire wraps w so the connection it is upgraded to is counted by
+// counter. Writers that can't be hijacked are returned as is, the upgrade
+// fails on them regardless.
+func countWire(w http.ResponseWriter, counter *wireCounter) http.ResponseWriter {
+	if _, ok := w.(http.Hijacker); !ok {
+		return w
+	}
+
+	return &countingResponseWriter{ResponseWriter: w, counter: counter}
+}